@@ -3,15 +3,285 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	dmn "github.com/application-research/delta-importer/daemon"
+	"github.com/application-research/delta-importer/daemon/api"
 	"github.com/application-research/delta-importer/db"
 	"github.com/application-research/delta-importer/util"
 	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
 
+// Flags for the daemon's settings. simulate takes the same flags, so it runs the importer with the settings the daemon would
+var DaemonFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "config",
+		Usage:   "path to a .toml or .yaml config file. flags and env vars override values from the file",
+		EnvVars: []string{"DI_CONFIG"},
+	},
+	&cli.StringFlag{
+		Name:        "boost-url",
+		Usage:       "ip address of boost",
+		DefaultText: "http://localhost",
+		Value:       "http://localhost",
+		EnvVars:     []string{"BOOST_URL"},
+	},
+	&cli.UintFlag{
+		Name:        "port",
+		Usage:       "port to run the daemon's API on",
+		DefaultText: "1313",
+		Value:       1313,
+		EnvVars:     []string{"DI_PORT"},
+	},
+	&cli.StringFlag{
+		Name:    "boost-auth-token",
+		Usage:   "eyJ....XXX (required)",
+		EnvVars: []string{"BOOST_AUTH_TOKEN"},
+	},
+	&cli.StringFlag{
+		Name:        "boost-gql-port",
+		Usage:       "graphql port for boost",
+		DefaultText: "8080",
+		Value:       "8080",
+		EnvVars:     []string{"BOOST_GQL_PORT"},
+	},
+	&cli.StringFlag{
+		Name:        "boost-port",
+		Usage:       "rpc port for boost",
+		DefaultText: "1288",
+		Value:       "1288",
+		EnvVars:     []string{"BOOST_PORT"},
+	},
+	&cli.IntFlag{
+		Name:    "max_concurrent",
+		Usage:   "stop importing if # of deals in sealing pipeline are above this threshold. 0 = unlimited.",
+		EnvVars: []string{"MAX_CONCURRENT"},
+	},
+	&cli.UintFlag{
+		Name:    "max-per-cycle",
+		Usage:   "maximum # of deals to import each interval. 0 = up to max_concurrent (or 1 if max_concurrent is unlimited)",
+		EnvVars: []string{"MAX_PER_CYCLE"},
+	},
+	&cli.UintFlag{
+		Name:        "import-parallelism",
+		Usage:       "# of deals to import at the same time",
+		Value:       1,
+		DefaultText: "1",
+		EnvVars:     []string{"IMPORT_PARALLELISM"},
+	},
+	&cli.UintFlag{
+		Name:        "retry-backoff",
+		Usage:       "seconds to wait before retrying a piece that could not be imported. doubles with each attempt, up to 24 hours",
+		Value:       600,
+		DefaultText: "600",
+		EnvVars:     []string{"RETRY_BACKOFF"},
+	},
+	&cli.UintFlag{
+		Name:        "max-attempts",
+		Usage:       "maximum # of times to attempt importing a piece. 0 = unlimited",
+		Value:       5,
+		DefaultText: "5",
+		EnvVars:     []string{"MAX_ATTEMPTS"},
+	},
+	&cli.IntFlag{
+		Name:    "interval",
+		Usage:   "interval, in seconds, to re-run the importer (required). with adaptive pacing, the longest interval",
+		EnvVars: []string{"INTERVAL"},
+	},
+	&cli.StringFlag{
+		Name:        "pacing",
+		Usage:       "how often to re-run the importer (fixed | adaptive). adaptive paces imports to hold the sealing pipeline at target-pipeline-depth",
+		Value:       "fixed",
+		DefaultText: "fixed",
+		EnvVars:     []string{"PACING"},
+	},
+	&cli.UintFlag{
+		Name:        "min-interval",
+		Usage:       "with adaptive pacing, the shortest interval, in seconds, to re-run the importer",
+		Value:       60,
+		DefaultText: "60",
+		EnvVars:     []string{"MIN_INTERVAL"},
+	},
+	&cli.UintFlag{
+		Name:    "target-pipeline-depth",
+		Usage:   "with adaptive pacing, the # of deals to hold in the sealing pipeline. defaults to max_concurrent",
+		EnvVars: []string{"TARGET_PIPELINE_DEPTH"},
+	},
+	&cli.StringFlag{
+		Name:    "address-book",
+		Usage:   "json file mapping client ID addresses (f0) to robust addresses (f1/f3), so deals made from either form match a dataset",
+		EnvVars: []string{"ADDRESS_BOOK"},
+	},
+	&cli.StringFlag{
+		Name:    "ddm-api",
+		Usage:   "url of ddm api (required only for pull modes)",
+		EnvVars: []string{"DDM_API"},
+	},
+	&cli.StringFlag{
+		Name:    "ddm-token",
+		Usage:   "auth token for pull-modes (self-service in DDM)",
+		EnvVars: []string{"DDM_TOKEN"},
+	},
+	&cli.UintFlag{
+		Name:        "ddm-delay-start",
+		Usage:       "# of days to delay start epoch for pull-mode deals (1-14)",
+		Value:       3,
+		DefaultText: "3",
+		EnvVars:     []string{"DDM_DELAY_START"},
+	},
+	&cli.UintFlag{
+		Name:        "ddm-advance-end",
+		Usage:       "# of days to bring forward the end epoch for pull-mode deals (0-20)",
+		Value:       0,
+		DefaultText: "0",
+		EnvVars:     []string{"DDM_ADVANCE_END"},
+	},
+	&cli.StringFlag{
+		Name:        "mode",
+		Usage:       "mode of operation (default | pull-dataset | pull-cid)",
+		Value:       "default",
+		DefaultText: "default",
+		EnvVars:     []string{"MODE"},
+	},
+	&cli.StringFlag{
+		Name:        "schedule",
+		Usage:       "how import slots are shared between datasets (priority | weighted)",
+		Value:       "priority",
+		DefaultText: "priority",
+		EnvVars:     []string{"SCHEDULE"},
+	},
+	&cli.StringFlag{
+		Name:        "deal-order",
+		Usage:       "order to import deals awaiting import in default mode (urgency | fifo | lifo | largest)",
+		Value:       "urgency",
+		DefaultText: "urgency",
+		EnvVars:     []string{"DEAL_ORDER"},
+	},
+	&cli.UintFlag{
+		Name:        "sealing-margin",
+		Usage:       "minutes to spare between a deal's expected time to proving and its start epoch, for it to be imported",
+		Value:       30,
+		DefaultText: "30",
+		EnvVars:     []string{"SEALING_MARGIN"},
+	},
+	&cli.UintFlag{
+		Name:        "expiry-warning",
+		Usage:       "hours before a deal awaiting import can no longer make its start epoch to log a warning about it (0 = no warnings)",
+		Value:       24,
+		DefaultText: "24",
+		EnvVars:     []string{"EXPIRY_WARNING"},
+	},
+	&cli.StringFlag{
+		Name:    "staging-dir",
+		Usage:   "directory to use for carfile staging",
+		EnvVars: []string{"STAGING_DIR"},
+	},
+	&cli.StringSliceFlag{
+		Name:    "staging-dirs",
+		Usage:   "additional directories to use for carfile staging (ex. on other disks)",
+		EnvVars: []string{"STAGING_DIRS"},
+	},
+	&cli.UintFlag{
+		Name:        "staging-reserve",
+		Usage:       "GiB to always leave free on each staging dir",
+		Value:       0,
+		DefaultText: "0",
+		EnvVars:     []string{"STAGING_RESERVE"},
+	},
+	&cli.StringFlag{
+		Name:        "staging-placement",
+		Usage:       "how to choose a staging dir for each carfile: most-free or round-robin",
+		Value:       "most-free",
+		DefaultText: "most-free",
+		EnvVars:     []string{"STAGING_PLACEMENT"},
+	},
+	&cli.StringFlag{
+		Name:        "staging-strategy",
+		Usage:       "how to stage carfiles: copy, hardlink, reflink or symlink. falls back to copy if a link can't be made",
+		Value:       "copy",
+		DefaultText: "copy",
+		EnvVars:     []string{"STAGING_STRATEGY"},
+	},
+	&cli.UintFlag{
+		Name:        "staging-rate-limit",
+		Usage:       "most MB/s to read from carfile sources when copying them to staging, across all copies (0 = no limit)",
+		Value:       0,
+		DefaultText: "0",
+		EnvVars:     []string{"STAGING_RATE_LIMIT"},
+	},
+	&cli.BoolFlag{
+		Name:        "staging-verify",
+		Usage:       "checksum each staging copy against its source",
+		Value:       false,
+		DefaultText: "false",
+		EnvVars:     []string{"STAGING_VERIFY"},
+	},
+	&cli.UintFlag{
+		Name:        "prefetch",
+		Usage:       "number of upcoming carfiles to copy into staging ahead of import (0 = no prefetching)",
+		Value:       0,
+		DefaultText: "0",
+		EnvVars:     []string{"PREFETCH"},
+	},
+	&cli.UintFlag{
+		Name:        "prefetch-budget",
+		Usage:       "most GiB of prefetched carfiles to keep in staging (0 = limited only by free space and staging-reserve)",
+		Value:       0,
+		DefaultText: "0",
+		EnvVars:     []string{"PREFETCH_BUDGET"},
+	},
+	&cli.BoolFlag{
+		Name:        "delete-after-import",
+		Usage:       "whether to delete source carfile after import complete",
+		Value:       false,
+		DefaultText: "false",
+		EnvVars:     []string{"DELETE_AFTER_IMPORT"},
+	},
+	&cli.BoolFlag{
+		Name:        "verify-commp",
+		Usage:       "compute the commp of each carfile before importing it, and quarantine carfiles that don't match the deal",
+		Value:       false,
+		DefaultText: "false",
+		EnvVars:     []string{"VERIFY_COMMP"},
+	},
+	&cli.StringFlag{
+		Name:    "quarantine-dir",
+		Usage:   "directory to move carfiles that fail verification to. defaults to a .quarantine directory next to the carfile",
+		EnvVars: []string{"QUARANTINE_DIR"},
+	},
+	&cli.UintFlag{
+		Name:        "shutdown-timeout",
+		Usage:       "seconds to wait for in-flight imports to finish on shutdown, before cancelling them",
+		Value:       300,
+		DefaultText: "300",
+		EnvVars:     []string{"SHUTDOWN_TIMEOUT"},
+	},
+	&cli.StringFlag{
+		Name:    "log",
+		Usage:   "log file to write to",
+		EnvVars: []string{"LOG"},
+	},
+	&cli.StringFlag{
+		Name:        "dir",
+		Usage:       "directory to store local files in",
+		Value:       "~/.delta/importer",
+		DefaultText: "~/.delta/importer",
+		EnvVars:     []string{"DELTA_DIR"},
+	},
+	&cli.BoolFlag{
+		Name:    "debug",
+		Usage:   "set to enable debug logging output",
+		EnvVars: []string{"DEBUG"},
+	},
+}
+
 func SetupCommands() []*cli.Command {
 	var commands []*cli.Command
 
@@ -20,130 +290,40 @@ func SetupCommands() []*cli.Command {
 		Name:    "daemon",
 		Aliases: []string{"d"},
 		Usage:   "run the delta-importer daemon to continuously import deals",
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:        "boost-url",
-				Usage:       "ip address of boost",
-				DefaultText: "http://localhost",
-				Value:       "http://localhost",
-				EnvVars:     []string{"BOOST_URL"},
-			},
-			&cli.UintFlag{
-				Name:        "port",
-				Usage:       "port to run the daemon's API on",
-				DefaultText: "1313",
-				Value:       1313,
-				EnvVars:     []string{"DI_PORT"},
-			},
-			&cli.StringFlag{
-				Name:     "boost-auth-token",
-				Usage:    "eyJ....XXX",
-				Required: true,
-				EnvVars:  []string{"BOOST_AUTH_TOKEN"},
-			},
-			&cli.StringFlag{
-				Name:        "boost-gql-port",
-				Usage:       "graphql port for boost",
-				DefaultText: "8080",
-				Value:       "8080",
-				EnvVars:     []string{"BOOST_GQL_PORT"},
-			},
-			&cli.StringFlag{
-				Name:        "boost-port",
-				Usage:       "rpc port for boost",
-				DefaultText: "1288",
-				Value:       "1288",
-				EnvVars:     []string{"BOOST_PORT"},
-			},
-			&cli.IntFlag{
-				Name:    "max_concurrent",
-				Usage:   "stop importing if # of deals in sealing pipeline are above this threshold. 0 = unlimited.",
-				EnvVars: []string{"MAX_CONCURRENT"},
-			},
-			&cli.IntFlag{
-				Name:     "interval",
-				Usage:    "interval, in seconds, to re-run the importer",
-				Required: true,
-				EnvVars:  []string{"INTERVAL"},
-			},
-			&cli.StringFlag{
-				Name:    "ddm-api",
-				Usage:   "url of ddm api (required only for pull modes)",
-				EnvVars: []string{"DDM_API"},
-			},
-			&cli.StringFlag{
-				Name:    "ddm-token",
-				Usage:   "auth token for pull-modes (self-service in DDM)",
-				EnvVars: []string{"DDM_TOKEN"},
-			},
-			&cli.UintFlag{
-				Name:        "ddm-delay-start",
-				Usage:       "# of days to delay start epoch for pull-mode deals (1-14)",
-				Value:       3,
-				DefaultText: "3",
-				EnvVars:     []string{"DDM_DELAY_START"},
-			},
-			&cli.UintFlag{
-				Name:        "ddm-advance-end",
-				Usage:       "# of days to bring forward the end epoch for pull-mode deals (0-20)",
-				Value:       0,
-				DefaultText: "0",
-				EnvVars:     []string{"DDM_ADVANCE_END"},
-			},
-			&cli.StringFlag{
-				Name:        "mode",
-				Usage:       "mode of operation (default | pull-dataset | pull-cid)",
-				Value:       "default",
-				DefaultText: "default",
-				EnvVars:     []string{"MODE"},
-			},
-			&cli.StringFlag{
-				Name:    "staging-dir",
-				Usage:   "directory to use for carfile staging",
-				EnvVars: []string{"STAGING_DIR"},
-			},
-			&cli.BoolFlag{
-				Name:        "delete-after-import",
-				Usage:       "whether to delete source carfile after import complete",
-				Value:       false,
-				DefaultText: "false",
-				EnvVars:     []string{"DELETE_AFTER_IMPORT"},
-			},
-			&cli.StringFlag{
-				Name:    "log",
-				Usage:   "log file to write to",
-				EnvVars: []string{"LOG"},
-			},
-			&cli.StringFlag{
-				Name:        "dir",
-				Usage:       "directory to store local files in",
-				Value:       "~/.delta/importer",
-				DefaultText: "~/.delta/importer",
-				EnvVars:     []string{"DELTA_DIR"},
-			},
-			&cli.BoolFlag{
-				Name:    "debug",
-				Usage:   "set to enable debug logging output",
-				EnvVars: []string{"DEBUG"},
-			},
-		},
+		Flags:   DaemonFlags,
 
 		Action: func(cctx *cli.Context) error {
+			cfg, err := dmn.CreateConfig(cctx)
+			if err != nil {
+				return err
+			}
+
 			logo := `Δ 𝔻𝕖𝕝𝕥𝕒  𝕀𝕞𝕡𝕠𝕣𝕥𝕖𝕣`
 			fmt.Println(util.Purple + logo + util.Reset)
 			fmt.Printf("\n--\n")
-			fmt.Println("Running in " + util.Red + cctx.String("mode") + util.Reset + " mode")
-			fmt.Println("Imports every " + util.Green + cctx.String("interval") + util.Reset + " seconds, until max-concurrent of " + util.Cyan + cctx.String("max_concurrent") + util.Reset + " is reached")
-			fmt.Println("Using data dir in " + util.Gray + cctx.String("dir") + util.Reset)
-			if cctx.String("staging-dir") != "" {
-				fmt.Println("> using staging dir in " + util.Gray + cctx.String("staging-dir") + util.Reset)
+			fmt.Println("Running in " + util.Red + string(cfg.Mode) + util.Reset + " mode")
+			if cfg.Pacing == dmn.PacingAdaptive {
+				target := cfg.TargetDepth
+				if target == 0 {
+					target = cfg.MaxConcurrent
+				}
+				fmt.Printf("Imports every "+util.Green+"%d-%d"+util.Reset+" seconds, pacing to hold "+util.Cyan+"%d"+util.Reset+" deals in the pipeline\n", cfg.MinInterval, cfg.Interval, target)
+			} else {
+				fmt.Printf("Imports every "+util.Green+"%d"+util.Reset+" seconds, until max-concurrent of "+util.Cyan+"%d"+util.Reset+" is reached\n", cfg.Interval, cfg.MaxConcurrent)
+			}
+			fmt.Println("Using data dir in " + util.Gray + cfg.DataDir + util.Reset)
+			if dirs := cfg.AllStagingDirs(); len(dirs) > 0 {
+				fmt.Println("> using staging dir in " + util.Gray + strings.Join(dirs, ", ") + util.Reset)
 			}
-			if cctx.Bool("delete-after-import") {
+			if cfg.Prefetch != 0 {
+				fmt.Printf("> prefetching the next "+util.Cyan+"%d"+util.Reset+" carfiles into staging\n", cfg.Prefetch)
+			}
+			if cfg.DeleteAfterImport {
 				fmt.Println(util.Red + "> carfiles will be deleted after import" + util.Reset)
 			}
-			fmt.Println("Importer API is available at" + util.Red + " 127.0.0.1:" + cctx.String("port") + util.Reset)
+			fmt.Printf("Importer API is available at"+util.Red+" 127.0.0.1:%d"+util.Reset+"\n", cfg.Port)
 
-			return dmn.RunDaemon(cctx)
+			return dmn.RunDaemon(cfg)
 		},
 	})
 
@@ -164,7 +344,7 @@ func SetupCommands() []*cli.Command {
 			}
 			defer closer()
 
-			var statsJson db.DealStats
+			var statsJson api.StatsResponse
 			err = json.Unmarshal(res, &statsJson)
 			if err != nil {
 				return fmt.Errorf("failed to parse %s", err)
@@ -186,9 +366,391 @@ func SetupCommands() []*cli.Command {
 			t.SetStyle(table.StyleColoredDark)
 			t.Render()
 
+			renderSchedule(statsJson.Schedule)
+			renderPacing(statsJson.Pacing)
+			renderSealing(statsJson.Sealing)
+			if len(statsJson.Staging.Dirs) > 0 {
+				renderStaging(statsJson.Staging)
+				if len(statsJson.Staging.Copies) > 0 {
+					renderStagingCopies(statsJson.Staging.Copies)
+				}
+			}
+
+			return nil
+		},
+	})
+
+	/* attempts command */
+	commands = append(commands, &cli.Command{
+		Name:  "attempts",
+		Usage: "view or clear the history of import attempts",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "list pieces that have been attempted, and when they will next be retried",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "dataset",
+						Usage: "only list attempts for this dataset",
+					},
+				}, CLIConnectFlags...),
+				Action: func(cctx *cli.Context) error {
+					c, err := NewCmdProcessor(cctx)
+					if err != nil {
+						return err
+					}
+
+					res, closer, err := c.MakeRequest("GET", "/api/v1/attempts?dataset="+url.QueryEscape(cctx.String("dataset")), nil)
+					if err != nil {
+						return fmt.Errorf("command failed %s", err)
+					}
+					defer closer()
+
+					var attempts []db.ImportAttempt
+					err = json.Unmarshal(res, &attempts)
+					if err != nil {
+						return fmt.Errorf("failed to parse %s", err)
+					}
+
+					t := table.NewWriter()
+					t.SetOutputMirror(os.Stdout)
+					t.AppendHeader(table.Row{"Piece CID", "Dataset", "Attempts", "Last Attempt", "Next Eligible", "Last Error"})
+					for _, a := range attempts {
+						t.AppendRow(table.Row{a.PieceCid, a.Dataset, a.Attempts, a.LastAttempt.Format(time.RFC3339), a.NextEligible.Format(time.RFC3339), a.LastError})
+					}
+					t.SetStyle(table.StyleColoredDark)
+					t.Render()
+
+					return nil
+				},
+			},
+			{
+				Name:  "clear",
+				Usage: "clear the attempt history for a piece or dataset, so it is retried on the next import cycle",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "piece-cid",
+						Usage: "piece cid to clear attempts for",
+					},
+					&cli.StringFlag{
+						Name:  "dataset",
+						Usage: "dataset to clear attempts for",
+					},
+				}, CLIConnectFlags...),
+				Action: func(cctx *cli.Context) error {
+					if cctx.String("piece-cid") == "" && cctx.String("dataset") == "" {
+						return fmt.Errorf("--piece-cid or --dataset must be supplied")
+					}
+
+					c, err := NewCmdProcessor(cctx)
+					if err != nil {
+						return err
+					}
+
+					q := url.Values{}
+					q.Set("piece_cid", cctx.String("piece-cid"))
+					q.Set("dataset", cctx.String("dataset"))
+					res, closer, err := c.MakeRequest("DELETE", "/api/v1/attempts?"+q.Encode(), nil)
+					if err != nil {
+						return fmt.Errorf("command failed %s", err)
+					}
+					defer closer()
+
+					var cleared api.ClearAttemptsResponse
+					err = json.Unmarshal(res, &cleared)
+					if err != nil {
+						return fmt.Errorf("failed to parse %s", err)
+					}
+
+					fmt.Printf("cleared attempt history for %d piece(s)\n", cleared.Cleared)
+					return nil
+				},
+			},
+		},
+	})
+
+	/* deals command */
+	commands = append(commands, &cli.Command{
+		Name:  "deals",
+		Usage: "view deals awaiting import",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "expiring",
+				Usage: "list deals awaiting import that can no longer be sealed before their start epoch",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "dataset",
+						Usage: "only list deals for this dataset",
+					},
+				}, CLIConnectFlags...),
+				Action: func(cctx *cli.Context) error {
+					c, err := NewCmdProcessor(cctx)
+					if err != nil {
+						return err
+					}
+
+					res, closer, err := c.MakeRequest("GET", "/api/v1/deals/expiring?dataset="+url.QueryEscape(cctx.String("dataset")), nil)
+					if err != nil {
+						return fmt.Errorf("command failed %s", err)
+					}
+					defer closer()
+
+					var deals []db.ExpiringDeal
+					err = json.Unmarshal(res, &deals)
+					if err != nil {
+						return fmt.Errorf("failed to parse %s", err)
+					}
+
+					t := table.NewWriter()
+					t.SetOutputMirror(os.Stdout)
+					t.AppendHeader(table.Row{"Deal UUID", "Piece CID", "Dataset", "Start Epoch", "Start Time", "First Seen", "Reason"})
+					for _, d := range deals {
+						t.AppendRow(table.Row{d.DealUuid, d.PieceCid, d.Dataset, d.StartEpoch, d.StartTime.Format(time.RFC3339), d.FirstSeen.Format(time.RFC3339), d.Reason})
+					}
+					t.SetStyle(table.StyleColoredDark)
+					t.Render()
+
+					return nil
+				},
+			},
+		},
+	})
+
+	/* simulate command */
+	commands = append(commands, &cli.Command{
+		Name:  "simulate",
+		Usage: "rehearse importer settings against a simulated boost, ddm and sealing pipeline. takes the same flags and config file as daemon",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:        "datasets",
+				Usage:       "datasets.json file to generate deals and carfiles for",
+				DefaultText: "datasets.json in dir",
+			},
+			&cli.UintFlag{
+				Name:        "duration",
+				Usage:       "simulated time to run for, in hours",
+				Value:       24,
+				DefaultText: "24",
+			},
+			&cli.Float64Flag{
+				Name:        "speed",
+				Usage:       "how many times faster than real time to run the simulation",
+				Value:       720,
+				DefaultText: "720",
+			},
+			&cli.UintFlag{
+				Name:        "deals",
+				Usage:       "number of deals/carfiles to generate per dataset",
+				Value:       200,
+				DefaultText: "200",
+			},
+			&cli.UintFlag{
+				Name:        "car-size",
+				Usage:       "size of each generated carfile, in GiB",
+				Value:       32,
+				DefaultText: "32",
+			},
+			&cli.UintFlag{
+				Name:        "sealers",
+				Usage:       "number of deals the simulated provider can seal in parallel",
+				Value:       8,
+				DefaultText: "8",
+			},
+			&cli.UintFlag{
+				Name:        "seal-time",
+				Usage:       "time for a deal to be sealed once sealing starts, in minutes",
+				Value:       300,
+				DefaultText: "300",
+			},
+			&cli.UintFlag{
+				Name:        "start-window",
+				Usage:       "default mode deals have start epochs spread randomly over this many hours",
+				Value:       72,
+				DefaultText: "72",
+			},
+			&cli.Int64Flag{
+				Name:        "seed",
+				Usage:       "random seed for generating deals",
+				Value:       1,
+				DefaultText: "1",
+			},
+		}, DaemonFlags...),
+		Action: func(cctx *cli.Context) error {
+			cfg, err := dmn.CreateSimulationConfig(cctx)
+			if err != nil {
+				return err
+			}
+
+			if cfg.Debug {
+				log.SetLevel(log.DebugLevel)
+			} else {
+				log.SetLevel(log.WarnLevel)
+			}
+
+			datasetsFile := filepath.Join(cfg.DataDir, "datasets.json")
+			if cctx.IsSet("datasets") {
+				datasetsFile, err = homedir.Expand(cctx.String("datasets"))
+				if err != nil {
+					return err
+				}
+			}
+
+			if cctx.Float64("speed") <= 0 {
+				return fmt.Errorf("speed must be greater than 0")
+			}
+
+			sc := dmn.SimulationConfig{
+				Config:          cfg,
+				DatasetsFile:    datasetsFile,
+				Duration:        time.Duration(cctx.Uint("duration")) * time.Hour,
+				Speed:           cctx.Float64("speed"),
+				DealsPerDataset: int(cctx.Uint("deals")),
+				CarSize:         int64(cctx.Uint("car-size")) << 30,
+				Sealers:         int(cctx.Uint("sealers")),
+				SealTime:        time.Duration(cctx.Uint("seal-time")) * time.Minute,
+				StartWindow:     time.Duration(cctx.Uint("start-window")) * time.Hour,
+				Seed:            cctx.Int64("seed"),
+			}
+
+			fmt.Printf("Simulating "+util.Green+"%s"+util.Reset+" in "+util.Red+"%s"+util.Reset+" mode (~%s real time)\n", sc.Duration, sc.Config.Mode, time.Duration(float64(sc.Duration)/sc.Speed).Round(time.Second))
+
+			report, err := dmn.RunSimulation(sc)
+			if err != nil {
+				return fmt.Errorf("simulation failed: %w", err)
+			}
+
+			t := table.NewWriter()
+			t.SetOutputMirror(os.Stdout)
+			t.AppendHeader(table.Row{"Metric", "Deals", "Bytes", "Per Day"})
+			t.AppendRows([]table.Row{
+				{"Imported", report.DealsImported, util.BytesToReadable(report.BytesImported), util.BytesToReadable(report.ImportedPerDay())},
+				{"Proving", report.DealsProving, util.BytesToReadable(report.BytesProving), util.BytesToReadable(report.ProvingPerDay())},
+			})
+			t.AppendSeparator()
+			t.AppendRows([]table.Row{
+				{"Missed start epoch (imported)", report.MissedImported, "", ""},
+				{"Missed start epoch (not imported)", report.MissedNotImported, "", ""},
+			})
+			t.SetStyle(table.StyleColoredDark)
+			t.Render()
+
+			renderSchedule(report.Schedule)
+			renderPacing(report.Pacing)
+
+			d := table.NewWriter()
+			d.SetOutputMirror(os.Stdout)
+			d.AppendHeader(table.Row{"Elapsed", "Pipeline Depth", "Import Interval"})
+			for _, sample := range report.PipelineDepth {
+				d.AppendRow(table.Row{sample.Elapsed, sample.Depth, sample.Interval})
+			}
+			d.SetStyle(table.StyleColoredDark)
+			d.Render()
+
 			return nil
 		},
 	})
 
 	return commands
 }
+
+// Print a table of each dataset's share of imports
+func renderSchedule(schedule api.ScheduleStats) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Dataset", "Priority", "Weight", "Target Share", "Actual Share", "Imports"})
+	for _, ds := range schedule.Datasets {
+		target := ""
+		if schedule.Policy == string(dmn.ScheduleWeighted) {
+			target = fmt.Sprintf("%.1f%%", ds.TargetShare*100)
+		}
+		t.AppendRow(table.Row{ds.Dataset, ds.Priority, ds.Weight, target, fmt.Sprintf("%.1f%%", ds.ActualShare*100), ds.Imports})
+	}
+	t.AppendFooter(table.Row{"", "", "", "", "Schedule", schedule.Policy})
+	t.SetStyle(table.StyleColoredDark)
+	t.Render()
+}
+
+// Print a table of the importer's pacing
+func renderPacing(pacing api.PacingStats) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Pacing", "Value"})
+	t.AppendRows([]table.Row{
+		{"Pipeline Depth", pacing.PipelineDepth},
+		{"Throughput (deals/hour)", fmt.Sprintf("%.1f", pacing.Throughput)},
+	})
+	if pacing.Pacing == string(dmn.PacingAdaptive) {
+		t.AppendRows([]table.Row{
+			{"Target Depth", pacing.TargetDepth},
+			{"Import Rate (deals/hour)", fmt.Sprintf("%.1f", pacing.ImportRate)},
+		})
+	}
+	t.AppendFooter(table.Row{"Interval", fmt.Sprintf("%ds (%s)", pacing.Interval, pacing.Pacing)})
+	t.SetStyle(table.StyleColoredDark)
+	t.Render()
+}
+
+// Print a table of the estimated time for a deal imported now to reach proving
+func renderSealing(sealing api.SealingStats) {
+	seconds := func(s uint) string {
+		return (time.Duration(s) * time.Second).String()
+	}
+	sealTime := seconds(sealing.SealTime)
+	if sealing.Samples < dmn.MIN_SEALING_SAMPLES {
+		sealTime += " (default, not enough deals have reached proving)"
+	} else {
+		sealTime += fmt.Sprintf(" (from %d deals)", sealing.Samples)
+	}
+
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Sealing Estimate", "Value"})
+	t.AppendRows([]table.Row{
+		{"Seal Time", sealTime},
+		{"Queue Time", fmt.Sprintf("%s (%d deals at %.1f/hour)", seconds(sealing.QueueTime), sealing.PipelineDepth, sealing.Throughput)},
+		{"Safety Margin", seconds(sealing.Margin)},
+	})
+	t.AppendFooter(table.Row{"Time to Proving", seconds(sealing.Estimate)})
+	t.SetStyle(table.StyleColoredDark)
+	t.Render()
+}
+
+// Print a table of the usage of each staging dir
+func renderStaging(staging api.StagingStats) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Staging Dir", "Free", "Available", "In Flight", "Staged", "Failures"})
+	for _, d := range staging.Dirs {
+		if d.Error != "" {
+			t.AppendRow(table.Row{d.Dir, d.Error, "", "", d.Staged, d.Failures})
+			continue
+		}
+		free := fmt.Sprintf("%s / %s", util.BytesToReadable(int64(d.Free)), util.BytesToReadable(int64(d.Total)))
+		t.AppendRow(table.Row{d.Dir, free, util.BytesToReadable(int64(d.Available)), util.BytesToReadable(int64(d.InFlight)), d.Staged, d.Failures})
+	}
+	t.AppendFooter(table.Row{"", "", "", "", "Placement", staging.Placement})
+	t.AppendFooter(table.Row{"", "", "", "", "Strategy", staging.Strategy})
+	t.AppendFooter(table.Row{"", "", "", "", "Reserve", util.BytesToReadable(int64(staging.Reserve))})
+	t.AppendFooter(table.Row{"", "", "", "", "Prefetched", fmt.Sprintf("%d (%s)", staging.Prefetched, util.BytesToReadable(int64(staging.PrefetchedBytes)))})
+	t.SetStyle(table.StyleColoredDark)
+	t.Render()
+}
+
+// Print a table of the copies into staging that are in progress
+func renderStagingCopies(copies []api.StagingCopyStats) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Copying", "To", "Progress", "Rate", "Started"})
+	for _, c := range copies {
+		progress := util.BytesToReadable(c.Copied)
+		if c.Size > 0 {
+			progress = fmt.Sprintf("%s / %s (%.0f%%)", progress, util.BytesToReadable(c.Size), 100*float64(c.Copied)/float64(c.Size))
+		}
+		if c.Resumed > 0 {
+			progress += ", resumed from " + util.BytesToReadable(c.Resumed)
+		}
+		t.AppendRow(table.Row{c.Source, c.Dir, progress, util.BytesToReadable(int64(c.Rate)) + "/s", c.Started.Format(time.DateTime)})
+	}
+	t.SetStyle(table.StyleColoredDark)
+	t.Render()
+}
@@ -0,0 +1,76 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/filecoin-project/go-address"
+)
+
+// AddressBook maps client ID addresses (f0...) to their robust addresses (f1.../f3...)
+// Boost records a deal's client address in whichever form the deal was made from, so a dataset's deals are matched on every form of its addresses
+type AddressBook struct {
+	robust map[string]string   // ID address -> robust address
+	ids    map[string][]string // robust address -> ID addresses
+}
+
+// Read an address book file - a JSON object of ID addresses to robust addresses, ex. {"f01234": "f1abc..."}
+// An empty file name gives an empty address book
+func LoadAddressBook(fileName string) (AddressBook, error) {
+	book := AddressBook{robust: make(map[string]string), ids: make(map[string][]string)}
+	if fileName == "" {
+		return book, nil
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return book, fmt.Errorf("error reading address book %s: %w", fileName, err)
+	}
+
+	var entries map[string]string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return book, fmt.Errorf("address book %s is in incorrect format: %w", fileName, err)
+	}
+
+	for id, robust := range entries {
+		if a, err := address.NewFromString(id); err != nil || a.Protocol() != address.ID {
+			return book, fmt.Errorf("address book %s: %q is not an ID address", fileName, id)
+		}
+		if a, err := address.NewFromString(robust); err != nil || a.Protocol() == address.ID {
+			return book, fmt.Errorf("address book %s: %q (for %s) is not a robust address", fileName, robust, id)
+		}
+
+		book.robust[id] = robust
+		book.ids[robust] = append(book.ids[robust], id)
+	}
+
+	return book, nil
+}
+
+// Every form of the addresses in the book - each address, its robust address if it is an ID address, and its ID addresses if it is robust
+func (b AddressBook) resolve(addresses []string) []string {
+	var resolved []string
+	seen := make(map[string]bool)
+	add := func(addr string) {
+		if !seen[addr] {
+			seen[addr] = true
+			resolved = append(resolved, addr)
+		}
+	}
+
+	for _, addr := range addresses {
+		add(addr)
+		robust, ok := b.robust[addr]
+		if ok {
+			add(robust)
+		} else {
+			robust = addr
+		}
+		for _, id := range b.ids[robust] {
+			add(id)
+		}
+	}
+
+	return resolved
+}
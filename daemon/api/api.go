@@ -4,9 +4,6 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
 
 	"github.com/application-research/delta-importer/db"
 	"github.com/labstack/echo/v4"
@@ -14,9 +11,13 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	OsSignal chan os.Signal
-)
+// DaemonState provides live state from the running daemon to the API
+type DaemonState interface {
+	ScheduleStats() ScheduleStats
+	PacingStats() PacingStats
+	StagingStats() StagingStats
+	SealingStats() SealingStats
+}
 
 type HttpError struct {
 	Code    int    `json:"code,omitempty"`
@@ -35,8 +36,9 @@ type HttpErrorResponse struct {
 	Error HttpError `json:"error"`
 }
 
-// RouterConfig configures the API node
-func InitializeEchoRouterConfig(db *db.DIDB, port uint) {
+// RouterConfig configures the API node and starts serving it in the background
+// Returns the echo instance so that it can be shut down
+func InitializeEchoRouterConfig(db *db.DIDB, port uint, state DaemonState) *echo.Echo {
 	// Echo instance
 	e := echo.New()
 
@@ -50,9 +52,17 @@ func InitializeEchoRouterConfig(db *db.DIDB, port uint) {
 	apiGroup := e.Group("/api/v1")
 
 	ConfigureHealthRouter(apiGroup)
-	ConfigureStatsRouter(apiGroup, db)
+	ConfigureStatsRouter(apiGroup, db, state)
+	ConfigureAttemptsRouter(apiGroup, db)
+	ConfigureDealsRouter(apiGroup, db)
 	// Start server
-	e.Logger.Fatal(e.Start(fmt.Sprintf("0.0.0.0:%d", (port)))) // configuration
+	go func() {
+		if err := e.Start(fmt.Sprintf("0.0.0.0:%d", (port))); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	return e
 }
 
 func ErrorHandler(err error, c echo.Context) {
@@ -93,9 +103,3 @@ func ErrorHandler(err error, c echo.Context) {
 		return
 	}
 }
-
-// LoopForever on signal processing
-func LoopForever() {
-	signal.Notify(OsSignal, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
-	<-OsSignal
-}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/application-research/delta-importer/db"
+	"github.com/labstack/echo/v4"
+)
+
+type ClearAttemptsResponse struct {
+	Cleared int64 `json:"cleared"`
+}
+
+// Routes for viewing and clearing the import attempt history, so failed pieces can be retried immediately
+func ConfigureAttemptsRouter(e *echo.Group, db *db.DIDB) {
+	attempts := e.Group("/attempts")
+
+	attempts.GET("", func(c echo.Context) error {
+		a, err := db.GetImportAttempts(c.QueryParam("dataset"))
+
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(200, a)
+	})
+
+	attempts.DELETE("", func(c echo.Context) error {
+		pieceCid := c.QueryParam("piece_cid")
+		dataset := c.QueryParam("dataset")
+
+		if pieceCid == "" && dataset == "" {
+			return &HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  http.StatusText(http.StatusBadRequest),
+				Details: "piece_cid or dataset must be supplied",
+			}
+		}
+
+		cleared, err := db.ClearImportAttempts(pieceCid, dataset)
+
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(200, ClearAttemptsResponse{Cleared: cleared})
+	})
+}
@@ -0,0 +1,21 @@
+package api
+
+import (
+	"github.com/application-research/delta-importer/db"
+	"github.com/labstack/echo/v4"
+)
+
+// Routes for viewing deals awaiting import, ex. those that can no longer make their start epoch
+func ConfigureDealsRouter(e *echo.Group, db *db.DIDB) {
+	deals := e.Group("/deals")
+
+	deals.GET("/expiring", func(c echo.Context) error {
+		d, err := db.GetExpiringDeals(c.QueryParam("dataset"))
+
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(200, d)
+	})
+}
@@ -1,11 +1,87 @@
 package api
 
 import (
+	"time"
+
 	"github.com/application-research/delta-importer/db"
 	"github.com/labstack/echo/v4"
 )
 
-func ConfigureStatsRouter(e *echo.Group, db *db.DIDB) {
+// StatsResponse embeds DealStats, so clients reading only the deal stats are unaffected
+type StatsResponse struct {
+	db.DealStats
+	Schedule ScheduleStats `json:"schedule"`
+	Pacing   PacingStats   `json:"pacing"`
+	Sealing  SealingStats  `json:"sealing"`
+	Staging  StagingStats  `json:"staging"`
+}
+
+type ScheduleStats struct {
+	Policy   string         `json:"policy"`
+	Datasets []DatasetShare `json:"datasets"`
+}
+
+type DatasetShare struct {
+	Dataset     string  `json:"dataset"`
+	Priority    int     `json:"priority"`
+	Weight      uint    `json:"weight"`
+	TargetShare float64 `json:"target_share,omitempty"`
+	ActualShare float64 `json:"actual_share"`
+	Imports     int     `json:"imports"`
+}
+
+type PacingStats struct {
+	Pacing        string  `json:"pacing"`
+	TargetDepth   uint    `json:"target_depth,omitempty"`
+	PipelineDepth int     `json:"pipeline_depth"`
+	Throughput    float64 `json:"throughput_per_hour"`            // Deals leaving the sealing pipeline per hour
+	ImportRate    float64 `json:"import_rate_per_hour,omitempty"` // Deals per hour being imported to hold the target depth
+	Interval      uint    `json:"interval"`                       // Seconds until the next import cycle
+}
+
+type SealingStats struct {
+	Estimate      uint    `json:"estimate"`       // Seconds a deal imported now is expected to take to reach proving
+	SealTime      uint    `json:"seal_time"`      // Seconds to seal with an empty pipeline, from recent deals
+	QueueTime     uint    `json:"queue_time"`     // Seconds to get through the pipeline at its current depth and throughput
+	Margin        uint    `json:"margin"`         // Seconds to spare before a deal's start epoch for it to be imported
+	Samples       int     `json:"samples"`        // Recent deals the seal time is based on
+	PipelineDepth int     `json:"pipeline_depth"` // Depth the queue time is based on
+	Throughput    float64 `json:"throughput_per_hour"`
+}
+
+type StagingStats struct {
+	Placement       string             `json:"placement,omitempty"`
+	Strategy        string             `json:"strategy,omitempty"`
+	Reserve         uint64             `json:"reserve_bytes"` // Bytes always left free on each dir
+	Prefetched      int                `json:"prefetched"`    // Carfiles staged ahead of import, waiting to be imported
+	PrefetchedBytes uint64             `json:"prefetched_bytes"`
+	Dirs            []StagingDirStats  `json:"dirs"`
+	Copies          []StagingCopyStats `json:"copies"` // Copies into staging in progress
+}
+
+type StagingDirStats struct {
+	Dir       string `json:"dir"`
+	Total     uint64 `json:"total_bytes"`
+	Free      uint64 `json:"free_bytes"`
+	Available uint64 `json:"available_bytes"` // Free space less the reserve and copies in progress
+	InFlight  uint64 `json:"in_flight_bytes"` // Space reserved for copies in progress
+	Staged    int    `json:"staged"`          // Carfiles staged since the daemon started
+	Failures  int    `json:"failures"`        // Failed copies since the daemon started
+	Error     string `json:"error,omitempty"`
+}
+
+type StagingCopyStats struct {
+	Name    string    `json:"name"`
+	Source  string    `json:"source"`
+	Dir     string    `json:"dir"`
+	Size    int64     `json:"size_bytes"` // -1 if not known (a compressed carfile without its size in the header)
+	Copied  int64     `json:"copied_bytes"`
+	Resumed int64     `json:"resumed_from_bytes,omitempty"`
+	Started time.Time `json:"started"`
+	Rate    float64   `json:"bytes_per_second"` // Average since the copy started (or was resumed)
+}
+
+func ConfigureStatsRouter(e *echo.Group, db *db.DIDB, state DaemonState) {
 	stats := e.Group("/stats")
 
 	stats.GET("", func(c echo.Context) error {
@@ -15,6 +91,12 @@ func ConfigureStatsRouter(e *echo.Group, db *db.DIDB) {
 			return err
 		}
 
-		return c.JSON(200, ds)
+		return c.JSON(200, StatsResponse{
+			DealStats: ds,
+			Schedule:  state.ScheduleStats(),
+			Pacing:    state.PacingStats(),
+			Staging:   state.StagingStats(),
+			Sealing:   state.SealingStats(),
+		})
 	})
 }
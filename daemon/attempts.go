@@ -0,0 +1,73 @@
+package daemon
+
+import (
+	"time"
+
+	"github.com/application-research/delta-importer/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// Longest time to wait before retrying a piece, however many times it has been attempted
+const MAX_RETRY_BACKOFF = time.Duration(24 * time.Hour)
+
+// attemptTracker records import attempts in the db, so that pieces are retried with backoff (and survive a restart)
+type attemptTracker struct {
+	db  *db.DIDB
+	cfg Config
+}
+
+// Returns true if the piece has never been attempted, or its backoff has passed and it has attempts remaining
+func (t attemptTracker) eligible(pieceCid string) bool {
+	a, err := t.db.GetImportAttempt(pieceCid)
+	if err != nil {
+		log.Errorf("could not check import attempts for %s: %s", pieceCid, err)
+		return false
+	}
+	if a == nil {
+		return true
+	}
+
+	if t.cfg.MaxAttempts != 0 && a.Attempts >= int(t.cfg.MaxAttempts) {
+		log.Tracef("skipping %s as it has reached the maximum of %d attempts", pieceCid, t.cfg.MaxAttempts)
+		return false
+	}
+
+	return !now().Before(a.NextEligible)
+}
+
+// Record an attempt at importing a piece. reason is empty when the piece was queued for import
+func (t attemptTracker) attempt(pieceCid string, dataset string, reason string) {
+	attempts := 0
+	a, err := t.db.GetImportAttempt(pieceCid)
+	if err != nil {
+		log.Errorf("could not get import attempts for %s: %s", pieceCid, err)
+	} else if a != nil {
+		attempts = a.Attempts
+	}
+
+	at := now()
+	err = t.db.RecordImportAttempt(pieceCid, dataset, reason, at, at.Add(retryBackoff(t.cfg, attempts+1)))
+	if err != nil {
+		log.Errorf("could not record import attempt for %s: %s", pieceCid, err)
+	}
+}
+
+// Record why the latest attempt at importing a piece failed
+func (t attemptTracker) failed(pieceCid string, reason string) {
+	if err := t.db.UpdateImportAttemptError(pieceCid, reason); err != nil {
+		log.Errorf("could not record import failure for %s: %s", pieceCid, err)
+	}
+}
+
+// Time to wait after an attempt before trying a piece again - retry-backoff, doubled for each previous attempt
+func retryBackoff(cfg Config, attempts int) time.Duration {
+	backoff := time.Duration(cfg.RetryBackoff) * time.Second
+	for i := 1; i < attempts && backoff < MAX_RETRY_BACKOFF; i++ {
+		backoff *= 2
+	}
+
+	if backoff > MAX_RETRY_BACKOFF {
+		return MAX_RETRY_BACKOFF
+	}
+	return backoff
+}
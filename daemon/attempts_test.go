@@ -0,0 +1,76 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/application-research/delta-importer/db"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	cases := []struct {
+		name         string
+		retryBackoff uint
+		attempts     int
+		expected     time.Duration
+	}{
+		{"first attempt", 600, 1, 10 * time.Minute},
+		{"second attempt doubles", 600, 2, 20 * time.Minute},
+		{"fourth attempt", 600, 4, 80 * time.Minute},
+		{"capped at a day", 600, 10, MAX_RETRY_BACKOFF},
+		{"cap doesn't overflow", 600, 1000, MAX_RETRY_BACKOFF},
+		{"backoff larger than the cap", 2 * 24 * 60 * 60, 1, MAX_RETRY_BACKOFF},
+		{"no backoff", 0, 5, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := retryBackoff(Config{RetryBackoff: c.retryBackoff}, c.attempts); got != c.expected {
+				t.Errorf("expected %s, got %s", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestAttemptEligible(t *testing.T) {
+	start := time.Now()
+	prevNow := now
+	defer func() { now = prevNow }()
+
+	cases := []struct {
+		name        string
+		maxAttempts uint
+		attempts    int
+		after       time.Duration // Time since the last attempt
+		expected    bool
+	}{
+		{"never attempted", 3, 0, 0, true},
+		{"within backoff", 3, 1, 5 * time.Minute, false},
+		{"backoff passed", 3, 1, 10 * time.Minute, true},
+		{"second backoff is doubled", 3, 2, 15 * time.Minute, false},
+		{"second backoff passed", 3, 2, 20 * time.Minute, true},
+		{"max attempts reached", 3, 3, 48 * time.Hour, false},
+		{"no max attempts", 0, 20, 48 * time.Hour, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			didb, err := db.OpenDIDB(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer didb.Close()
+			tracker := attemptTracker{db: didb, cfg: Config{RetryBackoff: 600, MaxAttempts: c.maxAttempts}}
+
+			now = func() time.Time { return start }
+			for i := 0; i < c.attempts; i++ {
+				tracker.attempt("baga-piece", "test", "")
+			}
+
+			now = func() time.Time { return start.Add(c.after) }
+			if got := tracker.eligible("baga-piece"); got != c.expected {
+				t.Errorf("expected eligible to be %t, got %t", c.expected, got)
+			}
+		})
+	}
+}
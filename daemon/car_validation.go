@@ -0,0 +1,289 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	util "github.com/application-research/delta-importer/util"
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	log "github.com/sirupsen/logrus"
+)
+
+type CarValidation string
+
+const (
+	// Don't check carfiles before importing them
+	CarValidationNone CarValidation = "none"
+	// Check the header and roots, and walk the block section for framing errors (ex. a truncated file)
+	CarValidationHeader CarValidation = "header"
+	// As header, and also check each block's data hashes to its CID. Reads the whole carfile
+	CarValidationFull CarValidation = "full"
+)
+
+// First bytes of a CARv2 file - a CARv1 header with version 2 and no roots
+var carV2Pragma = []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+
+// Size of the CARv2 header that follows the pragma: 16 bytes of characteristics, then data offset, data size and index offset
+const CARV2_HEADER_SIZE = 40
+
+// The largest block section we will read (matches go-car)
+const MAX_CAR_SECTION_SIZE = 32 << 20
+
+// Most bytes a CID can take up at the start of a block section (varint version, codec and hash prefix, and a 64-byte digest)
+const MAX_CID_SIZE = 128
+
+func (v CarValidation) valid() bool {
+	switch v {
+	case "", CarValidationNone, CarValidationHeader, CarValidationFull:
+		return true
+	}
+	return false
+}
+
+// carValidator checks carfiles are well-formed before import, at the validation level of their dataset
+type carValidator struct {
+	levels map[string]CarValidation
+}
+
+func newCarValidator(datasets []Dataset) carValidator {
+	v := carValidator{levels: make(map[string]CarValidation)}
+	for _, ds := range datasets {
+		v.levels[ds.Dataset] = ds.Validation
+	}
+	return v
+}
+
+// True if any dataset has validation turned on
+func (v carValidator) enabled() bool {
+	for _, level := range v.levels {
+		if level == CarValidationHeader || level == CarValidationFull {
+			return true
+		}
+	}
+	return false
+}
+
+// Pre-import check that fails if the carfile is malformed
+func (v carValidator) check(ctx context.Context, job *importJob) error {
+	level := v.levels[job.dataset]
+	if level != CarValidationHeader && level != CarValidationFull {
+		return nil
+	}
+
+	if err := validateCar(ctx, job.carFile, level == CarValidationFull); err != nil {
+		return fmt.Errorf("invalid carfile %s: %w", job.carFile, err)
+	}
+
+	log.Debugf("carfile %s passed %s validation", job.carFile, level)
+	return nil
+}
+
+// Check a CARv1 or CARv2 file's header and roots, and that its block section is correctly framed
+// If verifyBlocks is set, each block's data is also hashed and compared to its CID
+// Compressed carfiles are checked as they are decompressed
+func validateCar(ctx context.Context, path string, verifyBlocks bool) error {
+	if verifyBlocks || util.IsCompressed(path) {
+		return validateCarStream(ctx, path, verifyBlocks)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// The CARv1 payload - the whole file, or the data section of a CARv2
+	dataOffset, dataSize := int64(0), fi.Size()
+
+	pragma := make([]byte, len(carV2Pragma))
+	if _, err := io.ReadFull(f, pragma); err != nil {
+		return fmt.Errorf("could not read header: %w", err)
+	}
+	if bytes.Equal(pragma, carV2Pragma) {
+		dataOffset, dataSize, err = readCarV2Header(f)
+		if err != nil {
+			return err
+		}
+		if dataOffset+dataSize > fi.Size() {
+			return fmt.Errorf("truncated: CARv2 data section ends at %d but the file is %d bytes", dataOffset+dataSize, fi.Size())
+		}
+	}
+
+	data := io.NewSectionReader(f, dataOffset, dataSize)
+	headerSize, err := readCarV1Header(bufio.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	return walkCarSections(ctx, data, headerSize, dataSize)
+}
+
+// Check a carfile by reading it from start to end, reading every block (and hashing it, if verifyBlocks is set)
+func validateCarStream(ctx context.Context, path string, verifyBlocks bool) error {
+	r, err := util.OpenCarFile(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	br := bufio.NewReaderSize(r, 1<<20)
+	dataSize := int64(-1)
+
+	pragma, err := br.Peek(len(carV2Pragma))
+	if err != nil {
+		return fmt.Errorf("could not read header: %w", err)
+	}
+	if bytes.Equal(pragma, carV2Pragma) {
+		if _, err := br.Discard(len(carV2Pragma)); err != nil {
+			return fmt.Errorf("could not read header: %w", err)
+		}
+		var dataOffset int64
+		dataOffset, dataSize, err = readCarV2Header(br)
+		if err != nil {
+			return err
+		}
+		skip := dataOffset - int64(len(carV2Pragma)+CARV2_HEADER_SIZE)
+		if n, err := io.CopyN(io.Discard, br, skip); err != nil {
+			return fmt.Errorf("truncated: CARv2 data section starts at %d but the file is %d bytes", dataOffset, int64(len(carV2Pragma)+CARV2_HEADER_SIZE)+n)
+		}
+		br = bufio.NewReaderSize(io.LimitReader(br, dataSize), 1<<20)
+	}
+
+	headerSize, err := readCarV1Header(br)
+	if err != nil {
+		return err
+	}
+
+	end, err := readCarBlocks(ctx, br, headerSize, verifyBlocks)
+	if err != nil {
+		return err
+	}
+	if dataSize >= 0 && end != dataSize {
+		return fmt.Errorf("truncated: CARv2 data section is %d bytes but only %d were read", dataSize, end)
+	}
+	return nil
+}
+
+// Read the CARv2 header that follows the pragma, returning the offset and size of the CARv1 data section
+func readCarV2Header(r io.Reader) (int64, int64, error) {
+	header := make([]byte, CARV2_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, fmt.Errorf("could not read CARv2 header: %w", err)
+	}
+
+	dataOffset := int64(binary.LittleEndian.Uint64(header[16:24]))
+	dataSize := int64(binary.LittleEndian.Uint64(header[24:32]))
+	if dataOffset < int64(len(carV2Pragma)+CARV2_HEADER_SIZE) || dataSize <= 0 {
+		return 0, 0, fmt.Errorf("CARv2 header has an invalid data offset %d or size %d", dataOffset, dataSize)
+	}
+	return dataOffset, dataSize, nil
+}
+
+// Read and check a CARv1 header, returning its size
+func readCarV1Header(br *bufio.Reader) (int64, error) {
+	header, err := car.ReadHeader(br)
+	if err != nil {
+		return 0, fmt.Errorf("could not read CARv1 header: %w", err)
+	}
+	if header.Version != 1 {
+		return 0, fmt.Errorf("unsupported CAR version %d", header.Version)
+	}
+	if len(header.Roots) == 0 {
+		return 0, errors.New("header has no roots")
+	}
+
+	size, err := car.HeaderSize(header)
+	if err != nil {
+		return 0, fmt.Errorf("could not read CARv1 header: %w", err)
+	}
+	return int64(size), nil
+}
+
+// Walk the sections of the block section, checking the length and CID of each but skipping over the block data
+func walkCarSections(ctx context.Context, data io.ReaderAt, offset int64, end int64) error {
+	buf := make([]byte, binary.MaxVarintLen64+MAX_CID_SIZE)
+	for blocks := 0; offset < end; blocks++ {
+		if blocks%10000 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		n, err := data.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		length, lengthSize := binary.Uvarint(buf[:n])
+		if lengthSize <= 0 {
+			return fmt.Errorf("invalid section length at offset %d", offset)
+		}
+		if length > MAX_CAR_SECTION_SIZE {
+			return fmt.Errorf("section at offset %d is %d bytes, larger than the maximum of %d", offset, length, MAX_CAR_SECTION_SIZE)
+		}
+		next := offset + int64(lengthSize) + int64(length)
+		if next > end {
+			return fmt.Errorf("truncated: section at offset %d ends at %d but the data ends at %d", offset, next, end)
+		}
+
+		section := buf[lengthSize:n]
+		if uint64(len(section)) > length {
+			section = section[:length]
+		}
+		if _, _, err := cid.CidFromBytes(section); err != nil {
+			return fmt.Errorf("invalid CID in section at offset %d: %w", offset, err)
+		}
+
+		offset = next
+	}
+
+	return nil
+}
+
+// Read every block in the block section, returning the offset of its end
+// If verifyBlocks is set, each block's data is checked against its CID
+func readCarBlocks(ctx context.Context, br *bufio.Reader, offset int64, verifyBlocks bool) (int64, error) {
+	for blocks := 0; ; blocks++ {
+		if blocks%1000 == 0 && ctx.Err() != nil {
+			return offset, ctx.Err()
+		}
+
+		section, err := carutil.LdRead(br)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return offset, fmt.Errorf("truncated: section at offset %d is incomplete", offset)
+		}
+		if err != nil {
+			return offset, fmt.Errorf("could not read section at offset %d: %w", offset, err)
+		}
+
+		n, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			return offset, fmt.Errorf("invalid CID in section at offset %d: %w", offset, err)
+		}
+
+		if verifyBlocks {
+			sum, err := c.Prefix().Sum(section[n:])
+			if err != nil {
+				return offset, fmt.Errorf("could not hash block %s: %w", c, err)
+			}
+			if !sum.Equals(c) {
+				return offset, fmt.Errorf("block %s at offset %d does not match its CID (hashes to %s)", c, offset, sum)
+			}
+		}
+
+		offset += int64(carutil.LdSize(section))
+	}
+}
@@ -0,0 +1,163 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/application-research/delta-importer/db"
+	util "github.com/application-research/delta-importer/util"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	log "github.com/sirupsen/logrus"
+)
+
+// Name of the directory (next to the carfile) that carfiles failing verification are moved to, if quarantine-dir isn't set
+const QUARANTINE_DIR_NAME = ".quarantine"
+
+// commpVerifier computes the piece commitment of a carfile before import, and compares it to the deal's piece cid
+// Computed commPs are cached in the db by file path, size and modification time
+type commpVerifier struct {
+	db            *db.DIDB
+	quarantineDir string
+}
+
+// Pre-import check that fails (and quarantines the carfile) if its commP doesn't match the deal
+func (v commpVerifier) check(ctx context.Context, job *importJob) error {
+	pieceCid, err := v.commP(ctx, job.carFile, job.pieceSize)
+	if err != nil {
+		return fmt.Errorf("could not compute commp of %s: %w", job.carFile, err)
+	}
+
+	if pieceCid != job.pieceCid {
+		reason := fmt.Sprintf("commp mismatch: deal has %s, carfile %s has %s", job.pieceCid, job.carFile, pieceCid)
+		// A downloaded carfile would be downloaded again rather than picked up from quarantine, so it is deleted by the import queue instead
+		if job.fetched {
+			return fmt.Errorf("%s. deleted the downloaded carfile", reason)
+		}
+		return fmt.Errorf("%s. %s", reason, quarantine(job.carFile, v.quarantineDir))
+	}
+
+	log.Debugf("commp of %s matches deal %s", job.carFile, job.dealUuid)
+	return nil
+}
+
+// Returns the piece cid of a carfile, padded to pieceSize if it's larger than the carfile's own piece size
+func (v commpVerifier) commP(ctx context.Context, carFile string, pieceSize uint64) (string, error) {
+	fi, err := os.Stat(carFile)
+	if err != nil {
+		return "", err
+	}
+
+	raw, rawSize, found, err := v.db.GetCachedCommP(carFile, fi.Size(), fi.ModTime())
+	if err != nil {
+		log.Errorf("could not check commp cache for %s: %s", carFile, err)
+	}
+
+	var digest []byte
+	if found {
+		log.Debugf("using cached commp for %s", carFile)
+		c, err := cid.Decode(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid cached commp %s: %w", raw, err)
+		}
+		decoded, err := multihash.Decode(c.Hash())
+		if err != nil {
+			return "", fmt.Errorf("invalid cached commp %s: %w", raw, err)
+		}
+		digest = decoded.Digest
+	} else {
+		log.Infof("computing commp of %s", carFile)
+		digest, rawSize, err = computeCommP(ctx, carFile)
+		if err != nil {
+			return "", err
+		}
+
+		pieceCid, err := commPToCid(digest)
+		if err != nil {
+			return "", err
+		}
+		if err := v.db.CacheCommP(carFile, fi.Size(), fi.ModTime(), pieceCid, rawSize); err != nil {
+			log.Errorf("could not cache commp for %s: %s", carFile, err)
+		}
+	}
+
+	// The deal's piece may be larger than the carfile needs - pad the commitment up to it
+	if pieceSize > rawSize {
+		digest, err = commp.PadCommP(digest, rawSize, pieceSize)
+		if err != nil {
+			return "", fmt.Errorf("could not pad commp to %d: %w", pieceSize, err)
+		}
+	}
+
+	return commPToCid(digest)
+}
+
+// Reads the whole file (decompressing it, if compressed) to compute its raw commP, and the padded piece size it was computed for
+func computeCommP(ctx context.Context, path string) ([]byte, uint64, error) {
+	f, err := util.OpenCarFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	cp := &commp.Calc{}
+	buf := make([]byte, 4<<20)
+	for {
+		if ctx.Err() != nil {
+			cp.Reset()
+			return nil, 0, ctx.Err()
+		}
+
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, err := cp.Write(buf[:n]); err != nil {
+				cp.Reset()
+				return nil, 0, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cp.Reset()
+			return nil, 0, err
+		}
+	}
+
+	return cp.Digest()
+}
+
+// Piece cids are v1 cids with the fil-commitment-unsealed codec and a sha2-256-trunc254-padded multihash
+func commPToCid(digest []byte) (string, error) {
+	mh, err := multihash.Encode(digest, multihash.SHA2_256_TRUNC254_PADDED)
+	if err != nil {
+		return "", err
+	}
+	return cid.NewCidV1(cid.FilCommitmentUnsealed, mh).String(), nil
+}
+
+// Move a carfile that failed verification out of the dataset, so it isn't imported again
+// Returns a description of where it was moved to, to add to the failure reason
+func quarantine(carFile string, quarantineDir string) string {
+	if quarantineDir == "" {
+		quarantineDir = filepath.Join(filepath.Dir(carFile), QUARANTINE_DIR_NAME)
+	}
+
+	if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+		log.Errorf("could not create quarantine dir %s: %s", quarantineDir, err)
+		return "could not quarantine carfile"
+	}
+
+	dest := filepath.Join(quarantineDir, filepath.Base(carFile))
+	if err := os.Rename(carFile, dest); err != nil {
+		log.Errorf("could not quarantine %s: %s", carFile, err)
+		return "could not quarantine carfile"
+	}
+
+	log.Warnf("quarantined %s to %s", carFile, dest)
+	return "quarantined to " + dest
+}
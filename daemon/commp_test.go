@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/application-research/delta-importer/db"
+	"github.com/google/uuid"
+)
+
+func TestCommpMismatch(t *testing.T) {
+	didb, err := db.OpenDIDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer didb.Close()
+	v := commpVerifier{db: didb}
+
+	cases := []struct {
+		name        string
+		fetched     bool
+		quarantined bool
+	}{
+		{"local carfile is quarantined", false, true},
+		{"downloaded carfile is left for the import queue to delete", true, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			carFile := filepath.Join(dir, "baga-wrong.car")
+			if err := os.WriteFile(carFile, bytes.Repeat([]byte("car data "), 1000), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			job := &importJob{carFile: carFile, pieceCid: "baga-wrong", pieceSize: 16 << 10, dealUuid: uuid.New(), fetched: c.fetched}
+			if err := v.check(context.Background(), job); err == nil {
+				t.Fatal("expected a commp mismatch")
+			}
+
+			quarantined := filepath.Join(dir, QUARANTINE_DIR_NAME, "baga-wrong.car")
+			if _, err := os.Stat(quarantined); (err == nil) != c.quarantined {
+				t.Errorf("expected quarantined to be %t, got %v", c.quarantined, err)
+			}
+			if _, err := os.Stat(carFile); (err == nil) == c.quarantined {
+				t.Errorf("expected carfile to be left in place to be %t, got %v", !c.quarantined, err)
+			}
+		})
+	}
+}
@@ -1,35 +1,73 @@
 package daemon
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/BurntSushi/toml"
+	svc "github.com/application-research/delta-importer/services"
 	"github.com/mitchellh/go-homedir"
 	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
 )
 
+// Time to seal a deal assumed until enough deals have reached proving to measure it
 const MIN_SEALING_TIME = time.Duration(4 * time.Hour)
 
+// Config keys in the config file match the daemon's flag names
 type Config struct {
-	Port              uint
-	BoostAddress      string
-	BoostAPIKey       string
-	BoostPort         string
-	BoostGqlPort      string
-	Debug             bool
-	MaxConcurrent     uint
-	Interval          uint
-	Mode              Mode
-	DDMURL            string
-	DDMToken          string
-	DDMDelayStart     uint
-	DDMAdvanceEnd     uint
-	DataDir           string
-	StagingDir        string
-	DeleteAfterImport bool
-	Log               string
+	Port              uint           `toml:"port" yaml:"port"`
+	BoostAddress      string         `toml:"boost-url" yaml:"boost-url"`
+	BoostAPIKey       string         `toml:"boost-auth-token" yaml:"boost-auth-token"`
+	BoostPort         string         `toml:"boost-port" yaml:"boost-port"`
+	BoostGqlPort      string         `toml:"boost-gql-port" yaml:"boost-gql-port"`
+	Debug             bool           `toml:"debug" yaml:"debug"`
+	MaxConcurrent     uint           `toml:"max_concurrent" yaml:"max_concurrent"`
+	MaxPerCycle       uint           `toml:"max-per-cycle" yaml:"max-per-cycle"`
+	ImportParallelism uint           `toml:"import-parallelism" yaml:"import-parallelism"`
+	RetryBackoff      uint           `toml:"retry-backoff" yaml:"retry-backoff"`
+	MaxAttempts       uint           `toml:"max-attempts" yaml:"max-attempts"`
+	Interval          uint           `toml:"interval" yaml:"interval"`
+	MinInterval       uint           `toml:"min-interval" yaml:"min-interval"`
+	Pacing            Pacing         `toml:"pacing" yaml:"pacing"`
+	TargetDepth       uint           `toml:"target-pipeline-depth" yaml:"target-pipeline-depth"`
+	Mode              Mode           `toml:"mode" yaml:"mode"`
+	Schedule          SchedulePolicy `toml:"schedule" yaml:"schedule"`
+	DealOrder         DealOrder      `toml:"deal-order" yaml:"deal-order"`
+	SealingMargin     uint           `toml:"sealing-margin" yaml:"sealing-margin"`
+	ExpiryWarning     uint           `toml:"expiry-warning" yaml:"expiry-warning"`
+	DDMURL            string         `toml:"ddm-api" yaml:"ddm-api"`
+	DDMToken          string         `toml:"ddm-token" yaml:"ddm-token"`
+	DDMDelayStart     uint           `toml:"ddm-delay-start" yaml:"ddm-delay-start"`
+	DDMAdvanceEnd     uint           `toml:"ddm-advance-end" yaml:"ddm-advance-end"`
+	AddressBook       string         `toml:"address-book" yaml:"address-book"`
+	DataDir           string         `toml:"dir" yaml:"dir"`
+	StagingDir        string         `toml:"staging-dir" yaml:"staging-dir"`
+	StagingDirs       []string       `toml:"staging-dirs" yaml:"staging-dirs"`
+	StagingReserve    uint           `toml:"staging-reserve" yaml:"staging-reserve"`
+	StagingPlacement  string         `toml:"staging-placement" yaml:"staging-placement"`
+	StagingStrategy   string         `toml:"staging-strategy" yaml:"staging-strategy"`
+	StagingRateLimit  uint           `toml:"staging-rate-limit" yaml:"staging-rate-limit"`
+	StagingVerify     bool           `toml:"staging-verify" yaml:"staging-verify"`
+	Prefetch          uint           `toml:"prefetch" yaml:"prefetch"`
+	PrefetchBudget    uint           `toml:"prefetch-budget" yaml:"prefetch-budget"`
+	DeleteAfterImport bool           `toml:"delete-after-import" yaml:"delete-after-import"`
+	VerifyCommP       bool           `toml:"verify-commp" yaml:"verify-commp"`
+	QuarantineDir     string         `toml:"quarantine-dir" yaml:"quarantine-dir"`
+	Log               string         `toml:"log" yaml:"log"`
+	ShutdownTimeout   uint           `toml:"shutdown-timeout" yaml:"shutdown-timeout"`
+	addressBook       AddressBook    // Read from the address-book file when the config is created
 }
 
 type Mode string
@@ -40,67 +78,434 @@ const (
 	ModePullDataset Mode = "pull-dataset"
 )
 
-// Pull flags out of cli context and create a config object
+// Build a config object from (in increasing order of precedence) flag defaults, the config file, and any flags/env vars explicitly set
 func CreateConfig(cctx *cli.Context) (Config, error) {
+	config, err := loadConfig(cctx, nil)
+	if err != nil {
+		return config, err
+	}
 
-	config := Config{
-		Port:              cctx.Uint("port"),
-		BoostAddress:      cctx.String("boost-url"),
-		BoostAPIKey:       cctx.String("boost-auth-token"),
-		Debug:             cctx.Bool("debug"),
-		BoostGqlPort:      cctx.String("boost-gql-port"),
-		BoostPort:         cctx.String("boost-port"),
-		MaxConcurrent:     cctx.Uint("max_concurrent"),
-		Interval:          cctx.Uint("interval"),
-		Mode:              Mode(cctx.String("mode")),
-		DDMURL:            cctx.String("ddm-api"),
-		DDMToken:          cctx.String("ddm-token"),
-		DDMDelayStart:     cctx.Uint("ddm-delay-start"),
-		DDMAdvanceEnd:     cctx.Uint("ddm-advance-end"),
-		Log:               cctx.String("log"),
-		StagingDir:        cctx.String("staging-dir"),
-		DeleteAfterImport: cctx.Bool("delete-after-import"),
-		DataDir:           cctx.String("dir"),
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil && !os.IsExist(err) {
+		return config, fmt.Errorf("make root dir: %w", err)
 	}
 
-	// Validation
+	if config.Debug {
+		fmt.Printf("config: %+v", config)
+	}
 
-	// 1. Validate Mode
-	validModes := []Mode{ModeDefault, ModePullCID, ModePullDataset}
-	isValidMode := false
-	for _, mode := range validModes {
-		if config.Mode == mode {
-			isValidMode = true
-			break
+	return config, nil
+}
+
+// Create the config for a simulation, from the same flags and config file as the daemon.
+// The simulation provides its own Boost and DDM, so their settings don't need to be supplied
+func CreateSimulationConfig(cctx *cli.Context) (Config, error) {
+	return loadConfig(cctx, func(config *Config) {
+		config.BoostAddress = "simulation"
+		config.BoostAPIKey = "simulation"
+		config.DDMURL = "http://simulation"
+		config.DDMToken = "simulation"
+	})
+}
+
+// Read the config from flags and the config file, then validate it. override, if given, is applied before validation
+func loadConfig(cctx *cli.Context, override func(*Config)) (Config, error) {
+	var config Config
+	var problems []string
+
+	applyFlags(cctx, &config, false)
+
+	if configFile := cctx.String("config"); configFile != "" {
+		configFile, err := homedir.Expand(configFile)
+		if err != nil {
+			return config, err
+		}
+		invalidKeys, err := readConfigFile(configFile, &config)
+		if err != nil {
+			return config, err
 		}
+		problems = append(problems, invalidKeys...)
+	}
+
+	applyFlags(cctx, &config, true)
+	if override != nil {
+		override(&config)
 	}
-	if !isValidMode {
-		return config, errors.New("invalid mode: must be empty, default, pull-cid or pull-dataset")
+
+	// Paths are expanded first, so validation checks the paths that will be used
+	problems = append(problems, config.expandPaths()...)
+	problems = append(problems, config.validate()...)
+
+	book, err := LoadAddressBook(config.AddressBook)
+	if err != nil {
+		problems = append(problems, "address-book: "+err.Error())
+	}
+	config.addressBook = book
+
+	if len(problems) > 0 {
+		return config, errors.New("invalid configuration:\n  - " + strings.Join(problems, "\n  - "))
 	}
 
-	// 2. Validate DDMToken and DDMURL when Mode is pull-cid or pull-dataset
-	if config.Mode == ModePullCID || config.Mode == ModePullDataset {
-		if config.DDMToken == "" {
-			return config, errors.New("ddm-token must be supplied when mode is pull-cid or pull-dataset")
+	return config, nil
+}
+
+// Copy flag values into the config. If onlySet is true, only flags explicitly set on the command line or via env var are copied
+func applyFlags(cctx *cli.Context, config *Config, onlySet bool) {
+	use := func(name string) bool {
+		return !onlySet || cctx.IsSet(name)
+	}
+
+	if use("port") {
+		config.Port = cctx.Uint("port")
+	}
+	if use("boost-url") {
+		config.BoostAddress = cctx.String("boost-url")
+	}
+	if use("boost-auth-token") {
+		config.BoostAPIKey = cctx.String("boost-auth-token")
+	}
+	if use("debug") {
+		config.Debug = cctx.Bool("debug")
+	}
+	if use("boost-gql-port") {
+		config.BoostGqlPort = cctx.String("boost-gql-port")
+	}
+	if use("boost-port") {
+		config.BoostPort = cctx.String("boost-port")
+	}
+	if use("max_concurrent") {
+		config.MaxConcurrent = cctx.Uint("max_concurrent")
+	}
+	if use("max-per-cycle") {
+		config.MaxPerCycle = cctx.Uint("max-per-cycle")
+	}
+	if use("retry-backoff") {
+		config.RetryBackoff = cctx.Uint("retry-backoff")
+	}
+	if use("max-attempts") {
+		config.MaxAttempts = cctx.Uint("max-attempts")
+	}
+	if use("import-parallelism") {
+		config.ImportParallelism = cctx.Uint("import-parallelism")
+	}
+	if use("interval") {
+		config.Interval = cctx.Uint("interval")
+	}
+	if use("min-interval") {
+		config.MinInterval = cctx.Uint("min-interval")
+	}
+	if use("pacing") {
+		config.Pacing = Pacing(cctx.String("pacing"))
+	}
+	if use("target-pipeline-depth") {
+		config.TargetDepth = cctx.Uint("target-pipeline-depth")
+	}
+	if use("mode") {
+		config.Mode = Mode(cctx.String("mode"))
+	}
+	if use("schedule") {
+		config.Schedule = SchedulePolicy(cctx.String("schedule"))
+	}
+	if use("deal-order") {
+		config.DealOrder = DealOrder(cctx.String("deal-order"))
+	}
+	if use("sealing-margin") {
+		config.SealingMargin = cctx.Uint("sealing-margin")
+	}
+	if use("expiry-warning") {
+		config.ExpiryWarning = cctx.Uint("expiry-warning")
+	}
+	if use("address-book") {
+		config.AddressBook = cctx.String("address-book")
+	}
+	if use("ddm-api") {
+		config.DDMURL = cctx.String("ddm-api")
+	}
+	if use("ddm-token") {
+		config.DDMToken = cctx.String("ddm-token")
+	}
+	if use("ddm-delay-start") {
+		config.DDMDelayStart = cctx.Uint("ddm-delay-start")
+	}
+	if use("ddm-advance-end") {
+		config.DDMAdvanceEnd = cctx.Uint("ddm-advance-end")
+	}
+	if use("log") {
+		config.Log = cctx.String("log")
+	}
+	if use("staging-dir") {
+		config.StagingDir = cctx.String("staging-dir")
+	}
+	if use("staging-dirs") {
+		config.StagingDirs = cctx.StringSlice("staging-dirs")
+	}
+	if use("staging-reserve") {
+		config.StagingReserve = cctx.Uint("staging-reserve")
+	}
+	if use("staging-placement") {
+		config.StagingPlacement = cctx.String("staging-placement")
+	}
+	if use("staging-strategy") {
+		config.StagingStrategy = cctx.String("staging-strategy")
+	}
+	if use("staging-rate-limit") {
+		config.StagingRateLimit = cctx.Uint("staging-rate-limit")
+	}
+	if use("staging-verify") {
+		config.StagingVerify = cctx.Bool("staging-verify")
+	}
+	if use("prefetch") {
+		config.Prefetch = cctx.Uint("prefetch")
+	}
+	if use("prefetch-budget") {
+		config.PrefetchBudget = cctx.Uint("prefetch-budget")
+	}
+	if use("delete-after-import") {
+		config.DeleteAfterImport = cctx.Bool("delete-after-import")
+	}
+	if use("dir") {
+		config.DataDir = cctx.String("dir")
+	}
+	if use("verify-commp") {
+		config.VerifyCommP = cctx.Bool("verify-commp")
+	}
+	if use("quarantine-dir") {
+		config.QuarantineDir = cctx.String("quarantine-dir")
+	}
+	if use("shutdown-timeout") {
+		config.ShutdownTimeout = cctx.Uint("shutdown-timeout")
+	}
+}
+
+// Read a .toml or .yaml config file on top of the provided config
+// Keys that are not present in the file are left untouched. Returns a list of any unknown or mistyped keys found in the file
+func readConfigFile(fileName string, config *Config) ([]string, error) {
+	var invalidKeys []string
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file %s: %w", fileName, err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(fileName)); ext {
+	case ".toml":
+		// Each key is decoded on its own, so every mistyped key is reported rather than only the first
+		var keys map[string]toml.Primitive
+		md, err := toml.Decode(string(data), &keys)
+		if err != nil {
+			return nil, fmt.Errorf("config file %s is in incorrect format: %w", fileName, err)
 		}
-		if config.DDMURL == "" {
-			return config, errors.New("ddm-api must be supplied when mode is pull-cid or pull-dataset")
+
+		fields := tomlFields(config)
+		for key, value := range keys {
+			field, ok := fields[key]
+			if !ok {
+				invalidKeys = append(invalidKeys, key+": unknown key in "+fileName)
+				continue
+			}
+			// Decoded into a new value first, so a mistyped key leaves the field as it was
+			decoded := reflect.New(field.Type())
+			if err := md.PrimitiveDecode(value, decoded.Interface()); err != nil {
+				invalidKeys = append(invalidKeys, key+": "+err.Error()+" in "+fileName)
+				continue
+			}
+			field.Set(decoded.Elem())
+		}
+		sort.Strings(invalidKeys)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err := dec.Decode(config)
+		if err != nil && err != io.EOF {
+			var typeErr *yaml.TypeError
+			if !errors.As(err, &typeErr) {
+				return nil, fmt.Errorf("config file %s is in incorrect format: %w", fileName, err)
+			}
+			// Unknown keys and type mismatches are all collected into the TypeError
+			for _, e := range typeErr.Errors {
+				invalidKeys = append(invalidKeys, e+" in "+fileName)
+			}
 		}
+	default:
+		return nil, fmt.Errorf("unsupported config file extension %q: must be .toml, .yaml or .yml", ext)
 	}
 
-	dataDir, err := homedir.Expand(config.DataDir)
-	if err != nil {
-		return config, err
+	return invalidKeys, nil
+}
+
+// Map each toml key of the config to its field
+func tomlFields(config *Config) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if key := v.Type().Field(i).Tag.Get("toml"); key != "" {
+			fields[key] = v.Field(i)
+		}
 	}
-	if err := os.MkdirAll(dataDir, 0755); err != nil && !os.IsExist(err) {
-		return config, fmt.Errorf("make root dir: %w", err)
+	return fields
+}
+
+// Expand a leading ~ in every path in the config, returning a list of any that can't be expanded
+func (c *Config) expandPaths() []string {
+	var problems []string
+	expand := func(key string, path *string) {
+		expanded, err := homedir.Expand(*path)
+		if err != nil {
+			problems = append(problems, key+": "+err.Error())
+			return
+		}
+		*path = expanded
+	}
+
+	expand("dir", &c.DataDir)
+	expand("staging-dir", &c.StagingDir)
+	for i := range c.StagingDirs {
+		expand("staging-dirs", &c.StagingDirs[i])
 	}
+	expand("quarantine-dir", &c.QuarantineDir)
+	expand("log", &c.Log)
+	expand("address-book", &c.AddressBook)
 
-	config.DataDir = dataDir
+	return problems
+}
 
-	if config.Debug {
-		fmt.Printf("config: %+v", config)
+// Check every field of the config, returning a list of all problems found
+func (c *Config) validate() []string {
+	var problems []string
+	invalid := func(key string, format string, args ...interface{}) {
+		problems = append(problems, key+": "+fmt.Sprintf(format, args...))
 	}
 
-	return config, nil
+	if c.Port == 0 || c.Port > 65535 {
+		invalid("port", "must be between 1 and 65535, got %d", c.Port)
+	}
+	if c.BoostAddress == "" {
+		invalid("boost-url", "must be supplied")
+	}
+	if c.BoostAPIKey == "" {
+		invalid("boost-auth-token", "must be supplied")
+	}
+	if !isValidPort(c.BoostPort) {
+		invalid("boost-port", "must be a port number between 1 and 65535, got %q", c.BoostPort)
+	}
+	if !isValidPort(c.BoostGqlPort) {
+		invalid("boost-gql-port", "must be a port number between 1 and 65535, got %q", c.BoostGqlPort)
+	}
+	if c.ImportParallelism == 0 {
+		invalid("import-parallelism", "must be at least 1")
+	}
+	if c.Interval == 0 {
+		invalid("interval", "must be supplied and greater than 0")
+	}
+
+	switch c.Mode {
+	case ModeDefault, ModePullCID, ModePullDataset:
+	default:
+		invalid("mode", "must be default, pull-cid or pull-dataset, got %q", c.Mode)
+	}
+
+	switch c.Pacing {
+	case PacingFixed:
+	case PacingAdaptive:
+		if c.MinInterval == 0 || c.MinInterval > c.Interval {
+			invalid("min-interval", "must be between 1 and interval (%d) when pacing is adaptive, got %d", c.Interval, c.MinInterval)
+		}
+		if c.TargetDepth == 0 && c.MaxConcurrent == 0 {
+			invalid("target-pipeline-depth", "must be supplied (or max_concurrent set) when pacing is adaptive")
+		}
+	default:
+		invalid("pacing", "must be fixed or adaptive, got %q", c.Pacing)
+	}
+
+	switch c.Schedule {
+	case SchedulePriority, ScheduleWeighted:
+	default:
+		invalid("schedule", "must be priority or weighted, got %q", c.Schedule)
+	}
+	if !c.DealOrder.valid() {
+		invalid("deal-order", "must be urgency, fifo, lifo or largest, got %q", c.DealOrder)
+	}
+
+	if c.Mode == ModePullCID || c.Mode == ModePullDataset {
+		if c.DDMToken == "" {
+			invalid("ddm-token", "must be supplied when mode is pull-cid or pull-dataset")
+		}
+		if c.DDMURL == "" {
+			invalid("ddm-api", "must be supplied when mode is pull-cid or pull-dataset")
+		}
+	}
+	if c.DDMURL != "" {
+		u, err := url.Parse(c.DDMURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			invalid("ddm-api", "must be a valid url, got %q", c.DDMURL)
+		}
+	}
+	if c.DDMDelayStart < 1 || c.DDMDelayStart > 14 {
+		invalid("ddm-delay-start", "must be between 1 and 14, got %d", c.DDMDelayStart)
+	}
+	if c.DDMAdvanceEnd > 20 {
+		invalid("ddm-advance-end", "must be between 0 and 20, got %d", c.DDMAdvanceEnd)
+	}
+
+	if c.DataDir == "" {
+		invalid("dir", "must be supplied")
+	}
+	for _, dir := range c.AllStagingDirs() {
+		if fi, err := os.Stat(dir); err != nil {
+			invalid("staging-dir", "%s", err)
+		} else if !fi.IsDir() {
+			invalid("staging-dir", "%s is not a directory", dir)
+		}
+	}
+	switch svc.StagingPlacement(c.StagingPlacement) {
+	case svc.StagingMostFree, svc.StagingRoundRobin:
+	default:
+		invalid("staging-placement", "must be most-free or round-robin, got %q", c.StagingPlacement)
+	}
+	switch svc.StagingStrategy(c.StagingStrategy) {
+	case svc.StagingCopy, svc.StagingHardlink, svc.StagingReflink:
+	case svc.StagingSymlink:
+		// Boost reads the carfile through the symlink after the import returns, so the source can't be deleted then
+		if c.DeleteAfterImport {
+			invalid("staging-strategy", "symlink can't be used with delete-after-import, as Boost reads the source carfile through the symlink")
+		}
+	default:
+		invalid("staging-strategy", "must be copy, hardlink, reflink or symlink, got %q", c.StagingStrategy)
+	}
+	if c.Prefetch != 0 {
+		if len(c.AllStagingDirs()) == 0 {
+			invalid("prefetch", "carfiles can only be prefetched into a staging dir - set staging-dir or staging-dirs")
+		}
+		if c.Mode == ModePullDataset {
+			invalid("prefetch", "not supported in %s mode, as carfiles aren't known until DDM makes a deal", ModePullDataset)
+		}
+	}
+	if c.Log != "" {
+		if fi, err := os.Stat(filepath.Dir(c.Log)); err != nil || !fi.IsDir() {
+			invalid("log", "directory of log file %s does not exist", c.Log)
+		}
+	}
+
+	return problems
+}
+
+// All the staging dirs - staging-dir followed by staging-dirs
+func (c *Config) AllStagingDirs() []string {
+	var dirs []string
+	if c.StagingDir != "" {
+		dirs = append(dirs, c.StagingDir)
+	}
+	return append(dirs, c.StagingDirs...)
+}
+
+// Staging for the configured staging dirs, or nil if there are none
+func (c *Config) staging() *svc.Staging {
+	if len(c.AllStagingDirs()) == 0 {
+		return nil
+	}
+	return svc.NewStaging(c.AllStagingDirs(), uint64(c.StagingReserve)<<30, svc.StagingPlacement(c.StagingPlacement), svc.StagingStrategy(c.StagingStrategy), uint64(c.StagingRateLimit)*1000000, c.StagingVerify)
+}
+
+func isValidPort(port string) bool {
+	p, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && p != 0
 }
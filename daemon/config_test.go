@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadConfigFileListsEveryInvalidKey(t *testing.T) {
+	cases := []struct {
+		name     string
+		file     string
+		content  string
+		expected []string // Text identifying each invalid key in the problems
+	}{
+		{"toml", "config.toml", "port = \"abc\"\ninterval = \"x\"\nmode = \"pull-cid\"\nbogus = 1\n", []string{"port:", "interval:", "bogus:"}},
+		{"yaml", "config.yaml", "port: abc\ninterval: x\nmode: pull-cid\nbogus: 1\n", []string{"line 1:", "line 2:", "field bogus"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), c.file)
+			if err := os.WriteFile(fileName, []byte(c.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			config := Config{Port: 1313}
+			invalidKeys, err := readConfigFile(fileName, &config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, key := range c.expected {
+				found := false
+				for _, problem := range invalidKeys {
+					if strings.Contains(problem, key) {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("expected %s to be reported, got %v", key, invalidKeys)
+				}
+			}
+			if len(invalidKeys) != 3 {
+				t.Errorf("expected 3 invalid keys, got %v", invalidKeys)
+			}
+			if config.Mode != ModePullCID {
+				t.Errorf("expected valid keys to be read, got mode %q", config.Mode)
+			}
+		})
+	}
+}
@@ -1,23 +1,28 @@
 package daemon
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/application-research/delta-importer/daemon/api"
 	"github.com/application-research/delta-importer/db"
+	svc "github.com/application-research/delta-importer/services"
 	log "github.com/sirupsen/logrus"
-	"github.com/urfave/cli/v2"
 )
 
-func RunDaemon(cctx *cli.Context) error {
-	cfg, err := CreateConfig(cctx)
-	if err != nil {
-		return err
-	}
+// Creates a new connection to Boost from the daemon config. staging may be nil if the connection won't import carfiles
+// This is a variable so that it can be swapped out for a fake Boost
+var newBoostClient = func(cfg Config, staging *svc.Staging) (svc.BoostClient, error) {
+	return svc.NewBoostConnection(cfg.BoostAddress, cfg.BoostPort, cfg.BoostGqlPort, cfg.BoostAPIKey, staging, cfg.DeleteAfterImport)
+}
 
+func RunDaemon(cfg Config) error {
 	if cfg.Debug {
 		log.SetLevel(log.DebugLevel)
 	}
@@ -35,22 +40,146 @@ func RunDaemon(cctx *cli.Context) error {
 		log.Infof("log file not specified. outputting logs only to terminal")
 	}
 
-	ds := ReadInDatasetsFromFile(filepath.Join(cfg.DataDir + "/datasets.json"))
-	log.Debugf("datasets: %+v", ds)
+	// ctx is cancelled when a shutdown is requested
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	ds := NewDatasetStore(filepath.Join(cfg.DataDir + "/datasets.json"))
+	log.Debugf("datasets: %+v", ds.Datasets())
+	go ds.Watch(ctx)
 
 	db, err := db.OpenDIDB(cfg.DataDir)
 	if err != nil {
 		return fmt.Errorf("error opening db: %w", err)
 	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			log.Errorf("error closing db: %s", err)
+		}
+	}()
 
-	go api.InitializeEchoRouterConfig(db, cfg.Port)
+	sched := NewScheduler(cfg.Schedule)
+	pace := newPacer(cfg, db)
+	staging := cfg.staging()
+	e := api.InitializeEchoRouterConfig(db, cfg.Port, &daemonState{scheduler: sched, pacer: pace, staging: staging, db: db, cfg: cfg})
+
+	// Background tasks use the db, so they are waited for before it is closed
+	var background sync.WaitGroup
+	runInBackground := func(run func(ctx context.Context)) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			run(ctx)
+		}()
+	}
+
+	runInBackground(NewDealReconciler(cfg, db).Run)
+	runInBackground(newExpiryChecker(cfg, db, pace, ds).Run)
+	if cfg.Prefetch != 0 && staging != nil {
+		runInBackground(newPrefetcher(cfg, db, sched, pace, staging, ds).Run)
+	}
 
-	dr := NewDealReconciler(cfg, db)
-	go dr.Run()
+	// In-flight imports (staging copy + boost import) are allowed to finish after a shutdown is requested
+	// importCtx is only cancelled once the shutdown timeout has passed
+	importCtx, cancelImports := context.WithCancel(context.Background())
+	defer cancelImports()
 
+	go func() {
+		<-ctx.Done()
+		// Restore default signal handling, so a second signal will terminate immediately
+		stop()
+		log.Infof("shutdown requested, waiting up to %d seconds for in-flight imports to finish", cfg.ShutdownTimeout)
+		time.AfterFunc(time.Second*time.Duration(cfg.ShutdownTimeout), func() {
+			log.Warnf("shutdown timeout reached, cancelling in-flight imports")
+			cancelImports()
+		})
+	}()
+
+importLoop:
 	for {
 		log.Debugf("running import...")
-		importer(cfg, db, ds)
-		time.Sleep(time.Second * time.Duration(cfg.Interval))
+		importer(importCtx, ctx.Done(), cfg, db, sched, pace, staging, ds.Datasets())
+
+		select {
+		case <-ctx.Done():
+			break importLoop
+		case <-time.After(pace.wait()):
+		}
+	}
+
+	background.Wait()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Errorf("error shutting down api server: %s", err)
+	}
+
+	log.Infof("delta-importer shut down")
+	return nil
+}
+
+// daemonState exposes the running daemon's state to the API
+type daemonState struct {
+	scheduler *Scheduler
+	pacer     *pacer
+	staging   *svc.Staging
+	db        *db.DIDB
+	cfg       Config
+}
+
+func (s *daemonState) ScheduleStats() api.ScheduleStats {
+	return s.scheduler.Stats()
+}
+
+func (s *daemonState) PacingStats() api.PacingStats {
+	return s.pacer.Stats()
+}
+
+func (s *daemonState) SealingStats() api.SealingStats {
+	depth, throughput := s.pacer.pipeline()
+	return estimateSealing(s.db, depth, throughput, time.Minute*time.Duration(s.cfg.SealingMargin)).Stats()
+}
+
+func (s *daemonState) StagingStats() api.StagingStats {
+	if s.staging == nil {
+		return api.StagingStats{}
+	}
+
+	prefetched, prefetchedBytes := s.staging.Prefetched()
+	stats := api.StagingStats{
+		Placement:       string(s.staging.Placement()),
+		Strategy:        string(s.staging.Strategy()),
+		Reserve:         s.staging.Reserve(),
+		Prefetched:      len(prefetched),
+		PrefetchedBytes: prefetchedBytes,
+	}
+	for _, u := range s.staging.Usage() {
+		stats.Dirs = append(stats.Dirs, api.StagingDirStats{
+			Dir:       u.Dir,
+			Total:     u.Total,
+			Free:      u.Free,
+			Available: u.Available,
+			InFlight:  u.InFlight,
+			Staged:    u.Staged,
+			Failures:  u.Failures,
+			Error:     u.Err,
+		})
+	}
+	for _, c := range s.staging.Copies() {
+		copied := api.StagingCopyStats{
+			Name:    c.Name,
+			Source:  c.Source,
+			Dir:     c.Dir,
+			Size:    c.Size,
+			Copied:  c.Copied,
+			Resumed: c.Resumed,
+			Started: c.Started,
+		}
+		if elapsed := time.Since(c.Started).Seconds(); elapsed > 0 {
+			copied.Rate = float64(c.Copied-c.Resumed) / elapsed
+		}
+		stats.Copies = append(stats.Copies, copied)
 	}
+	return stats
 }
@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/application-research/delta-importer/db"
+	svc "github.com/application-research/delta-importer/services"
+	util "github.com/application-research/delta-importer/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// datasetBudget tracks a dataset's usage against its own limits over an import cycle
+// Limits are checked before each import, so a dataset may go over a byte limit by at most one carfile
+type datasetBudget struct {
+	ds            Dataset
+	inPipeline    int
+	pipelineBytes int64
+	importedToday int64
+}
+
+// Work out each dataset's current usage from the deals in the sealing pipeline (grouped by client address, in any form in the address book) and the imports recorded in the db
+func newDatasetBudgets(datasets []Dataset, inPipeline svc.BoostDeals, book AddressBook, didb *db.DIDB) map[string]*datasetBudget {
+	budgets := make(map[string]*datasetBudget)
+	byAddress := make(map[string]*datasetBudget)
+
+	for _, ds := range datasets {
+		b := &datasetBudget{ds: ds}
+		budgets[ds.Dataset] = b
+		for _, addr := range book.resolve(ds.Addresses) {
+			byAddress[addr] = b
+		}
+
+		if ds.DailyByteQuota != 0 {
+			imported, err := didb.GetBytesImportedSince(ds.Dataset, now().Add(-24*time.Hour))
+			if err != nil {
+				log.Errorf("could not get bytes imported for dataset %s: %s", ds.Dataset, err)
+				// Err on the side of not importing
+				imported = ds.DailyByteQuota
+			}
+			b.importedToday = imported
+		}
+	}
+
+	for _, deal := range inPipeline {
+		if b, ok := byAddress[deal.ClientAddress]; ok {
+			b.inPipeline++
+			b.pipelineBytes += int64(deal.PieceSize.Uint64())
+		}
+	}
+
+	return budgets
+}
+
+// Returns the reason the dataset can't import any more deals, or an empty string if it can
+func (b *datasetBudget) exhausted() string {
+	if b == nil {
+		return ""
+	}
+
+	if b.ds.MaxConcurrent != 0 && b.inPipeline >= int(b.ds.MaxConcurrent) {
+		return fmt.Sprintf("%d deals in sealing pipeline (max_concurrent is %d)", b.inPipeline, b.ds.MaxConcurrent)
+	}
+	if b.ds.MaxBytesInPipeline != 0 && b.pipelineBytes >= b.ds.MaxBytesInPipeline {
+		return fmt.Sprintf("%s in sealing pipeline (max_bytes_in_pipeline is %s)", util.BytesToReadable(b.pipelineBytes), util.BytesToReadable(b.ds.MaxBytesInPipeline))
+	}
+	if b.ds.DailyByteQuota != 0 && b.importedToday >= b.ds.DailyByteQuota {
+		return fmt.Sprintf("%s imported in the last 24 hours (daily_byte_quota is %s)", util.BytesToReadable(b.importedToday), util.BytesToReadable(b.ds.DailyByteQuota))
+	}
+
+	return ""
+}
+
+// Count a queued deal of the given padded piece size against the dataset's limits
+func (b *datasetBudget) add(size int64) {
+	if b == nil {
+		return
+	}
+
+	b.inPipeline++
+	b.pipelineBytes += size
+	b.importedToday += size
+}
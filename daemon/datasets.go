@@ -3,10 +3,13 @@ package daemon
 import (
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	svc "github.com/application-research/delta-importer/services"
 	util "github.com/application-research/delta-importer/util"
@@ -14,99 +17,380 @@ import (
 )
 
 type Dataset struct {
-	Dataset             string          `json:"dataset"`
-	Addresses           []string        `json:"address"`
-	Dir                 string          `json:"dir"`
-	Ignore              bool            `json:"ignore,omitempty"`
-	alreadyImportedCids map[string]bool `json:"omitempty"`
+	Dataset             string         `json:"dataset"`
+	Addresses           []string       `json:"address"`
+	Dir                 string         `json:"dir"`
+	Dirs                []string       `json:"dirs,omitempty"`            // Additional dirs (ex. on other mounts) to find carfiles in
+	Recursive           bool           `json:"recursive,omitempty"`       // Search subdirectories of each dir for carfiles
+	MaxDepth            int            `json:"max_depth,omitempty"`       // Levels of subdirectories to search when recursive. 0 = unlimited
+	ShardTemplates      []string       `json:"shard_templates,omitempty"` // Carfile paths relative to each dir. Defaults to {piece_cid}.car
+	Manifest            string         `json:"manifest,omitempty"`        // CSV or JSON manifest mapping piece cids to carfiles
+	Source              *DatasetSource `json:"source,omitempty"`          // Where to fetch carfiles from, if they aren't on a local filesystem
+	Ignore              bool           `json:"ignore,omitempty"`
+	Priority            int            `json:"priority,omitempty"`              // Higher priority datasets are imported first (priority schedule)
+	Weight              uint           `json:"weight,omitempty"`                // Relative share of import slots (weighted schedule). Defaults to 1
+	MaxConcurrent       uint           `json:"max_concurrent,omitempty"`        // Maximum # of the dataset's deals in the sealing pipeline. 0 = unlimited
+	MaxBytesInPipeline  int64          `json:"max_bytes_in_pipeline,omitempty"` // Maximum bytes (piece size) of the dataset's deals in the sealing pipeline. 0 = unlimited
+	DailyByteQuota      int64          `json:"daily_byte_quota,omitempty"`      // Maximum bytes imported for the dataset in any 24 hours. 0 = unlimited
+	Validation          CarValidation  `json:"validation,omitempty"`            // Check carfiles are well-formed before import: none (default), header or full
+	alreadyImportedCids *importedCids  `json:"-"`
+	index               *carFileIndex  `json:"-"`
+	manifest            *manifestIndex `json:"-"`
 }
 
-// Read the datasets file and return a map of Dataset structs keyed by their Dataset name
-func ReadInDatasetsFromFile(fileName string) map[string]Dataset {
+// Piece cids of a dataset that are already imported. Shared by every copy of the dataset, so is used by both the importer and prefetcher
+type importedCids struct {
+	mu   sync.Mutex
+	cids map[string]bool
+}
+
+// Carfiles found by searching a dataset's dirs, by file name
+type carFileIndex struct {
+	mu    sync.Mutex
+	built time.Time
+	paths map[string]string
+}
+
+// How long a recursive search of a dataset's dirs is reused for before searching again
+const CAR_INDEX_TTL = time.Duration(1 * time.Minute)
+
+// Read the datasets file and return the Dataset structs, in the order they appear in the file
+// Exits the process if the file is missing or invalid - use LoadDatasetsFromFile to handle errors instead
+func ReadInDatasetsFromFile(fileName string) []Dataset {
+	if !util.FileExists(fileName) {
+		fmt.Println(">> delta-importer can't seem to find the " + util.Purple + "datasets.json" + util.Reset + " file. it should be located at " + util.Cyan + fileName + util.Reset + ". please populate this file and try again. see the README for more information.")
+		os.Exit(1)
+	}
+
+	datasets, err := LoadDatasetsFromFile(fileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return datasets
+}
+
+// Read and validate the datasets file, returning the Dataset structs in the order they appear in the file
+// Ignored datasets are left out
+func LoadDatasetsFromFile(fileName string) ([]Dataset, error) {
 	data, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		if err.Error() == "open "+fileName+": no such file or directory" {
-			fmt.Println(">> delta-importer can't seem to find the " + util.Purple + "datasets.json" + util.Reset + " file. it should be located at " + util.Cyan + fileName + util.Reset + ". please populate this file and try again. see the README for more information.")
-			os.Exit(1)
-		} else {
-			log.Fatalf("error reading datasets file at %s", fileName)
-		}
+		return nil, fmt.Errorf("error reading datasets file at %s: %w", fileName, err)
 	}
 
 	var datasets []Dataset
 	err = json.Unmarshal(data, &datasets)
 	if err != nil {
-		log.Fatalf("datasets file is in incorrect format: %v", err)
+		return nil, fmt.Errorf("datasets file is in incorrect format: %w", err)
 	}
 
-	datasetMap := make(map[string]Dataset)
-	for _, dataset := range datasets {
+	seen := make(map[string]bool)
+	var active []Dataset
+	for i, dataset := range datasets {
+		if dataset.Dataset == "" {
+			return nil, fmt.Errorf("dataset at position %d in datasets file has no name", i)
+		}
+
 		if dataset.Ignore {
 			continue
 		}
 
-		if _, exists := datasetMap[dataset.Dataset]; exists {
-			log.Fatalf("duplicate dataset name '%s' found in datasets file", dataset.Dataset)
+		if seen[dataset.Dataset] {
+			return nil, fmt.Errorf("duplicate dataset name '%s' found in datasets file", dataset.Dataset)
+		}
+		seen[dataset.Dataset] = true
+
+		if len(dataset.dirs()) == 0 && dataset.Manifest == "" && dataset.Source == nil {
+			return nil, fmt.Errorf("dataset '%s' has no dir, dirs, manifest or source", dataset.Dataset)
+		}
+		if dataset.Source != nil {
+			if err := dataset.Source.validate(); err != nil {
+				return nil, fmt.Errorf("dataset '%s': %w", dataset.Dataset, err)
+			}
+		}
+		if dataset.MaxDepth < 0 {
+			return nil, fmt.Errorf("dataset '%s' has a negative max_depth", dataset.Dataset)
+		}
+		for _, t := range dataset.templates() {
+			if err := t.validate(); err != nil {
+				return nil, fmt.Errorf("dataset '%s': %w", dataset.Dataset, err)
+			}
+		}
+
+		if dataset.MaxBytesInPipeline < 0 || dataset.DailyByteQuota < 0 {
+			return nil, fmt.Errorf("dataset '%s' has a negative byte limit", dataset.Dataset)
+		}
+
+		if !dataset.Validation.valid() {
+			return nil, fmt.Errorf("dataset '%s' has an invalid validation '%s' - must be none, header or full", dataset.Dataset, dataset.Validation)
+		}
+
+		if dataset.Weight == 0 {
+			dataset.Weight = 1
 		}
-		dataset.alreadyImportedCids = make(map[string]bool)
-		datasetMap[dataset.Dataset] = dataset
+		dataset.alreadyImportedCids = &importedCids{cids: make(map[string]bool)}
+		dataset.index = &carFileIndex{}
+
+		if dataset.Manifest != "" {
+			// Relative manifest paths are relative to the datasets file
+			if !filepath.IsAbs(dataset.Manifest) {
+				dataset.Manifest = filepath.Join(filepath.Dir(fileName), dataset.Manifest)
+			}
+			dataset.manifest, err = newManifestIndex(dataset.Manifest)
+			if err != nil {
+				return nil, fmt.Errorf("dataset '%s': %w", dataset.Dataset, err)
+			}
+		}
+		active = append(active, dataset)
 	}
 
-	return datasetMap
+	return active, nil
 }
 
-// Returns a list of all the car files in a given directory
+// All the dirs carfiles for the dataset may be in
+func (d *Dataset) dirs() []string {
+	var dirs []string
+	if d.Dir != "" {
+		dirs = append(dirs, d.Dir)
+	}
+	return append(dirs, d.Dirs...)
+}
+
+func (d *Dataset) templates() []shardTemplate {
+	if len(d.ShardTemplates) == 0 {
+		return []shardTemplate{DEFAULT_SHARD_TEMPLATE}
+	}
+
+	var templates []shardTemplate
+	for _, t := range d.ShardTemplates {
+		templates = append(templates, shardTemplate(t))
+	}
+	return templates
+}
+
+// Levels of subdirectories to search for carfiles. -1 = unlimited
+// Without recursion, only as deep as the shard templates place carfiles
+func (d *Dataset) searchDepth() int {
+	if d.Recursive {
+		if d.MaxDepth == 0 {
+			return -1
+		}
+		return d.MaxDepth
+	}
+
+	depth := 0
+	for _, t := range d.templates() {
+		if t.depth() > depth {
+			depth = t.depth()
+		}
+	}
+	return depth
+}
+
+// Returns the paths of all car files (including compressed car files) in the dataset's dirs
 func (d *Dataset) CarFilePaths() []string {
-	files, err := ioutil.ReadDir(d.Dir)
-	if err != nil {
-		log.Errorf("error reading directory %s: %v", d.Dir, err)
-		return nil
+	var fileNames []string
+	for _, dir := range d.dirs() {
+		fileNames = append(fileNames, findCarFiles(dir, d.searchDepth())...)
 	}
 
+	return fileNames
+}
+
+// Find car files in dir, and up to maxDepth levels of subdirectories below it (-1 = unlimited)
+func findCarFiles(dir string, maxDepth int) []string {
 	var fileNames []string
-	for _, f := range files {
-		if !f.IsDir() && strings.HasSuffix(f.Name(), ".car") {
-			fileNames = append(fileNames, filepath.Join(d.Dir, f.Name()))
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			log.Errorf("error reading directory %s: %v", path, err)
+			if entry != nil && entry.IsDir() && path != dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if entry.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			if maxDepth >= 0 && rel != "." && strings.Count(filepath.ToSlash(rel), "/")+1 > maxDepth {
+				return filepath.SkipDir
+			}
+			return nil
 		}
+
+		if util.IsCarFile(entry.Name()) {
+			fileNames = append(fileNames, path)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("error reading directory %s: %v", dir, err)
 	}
 
 	return fileNames
 }
 
+// A carfile in the dataset, and the piece cid it is for
+type carFile struct {
+	pieceCid string
+	path     string
+}
+
+// Returns all the carfiles in the dataset - from the manifest if there is one, otherwise from the dirs (assuming files are named <pieceCid>.car)
+// Remote datasets can't be listed, so only have carfiles if they have a manifest
+func (d *Dataset) carFiles() []carFile {
+	var files []carFile
+	if d.manifest != nil {
+		for _, e := range d.manifest.all() {
+			path := e.FilePath
+			if d.Source != nil {
+				path = d.Source.url(e.PieceCid)
+			}
+			files = append(files, carFile{pieceCid: e.PieceCid, path: path})
+		}
+		return files
+	}
+	if d.Source != nil {
+		return nil
+	}
+
+	for _, path := range d.CarFilePaths() {
+		files = append(files, carFile{pieceCid: util.FileNameFromPath(util.TrimCompressionExt(path)), path: path})
+	}
+	return files
+}
+
 // Returns the path to a car file in the dataset given a piece cid
+// The manifest is used if there is one. Otherwise each dir is tried with each shard template, then (if recursive) a search of the dirs
+// At each location, a compressed carfile (ex. <pieceCid>.car.zst) is used if there is no uncompressed one
+// If the carfile can't be found, the first candidate path is returned
+// For remote datasets, the URL to fetch the carfile from is returned
 func (d *Dataset) GenerateCarFileName(pieceCid string) string {
-	return filepath.Join(d.Dir, pieceCid+".car")
+	if d.Source != nil {
+		return d.Source.url(pieceCid)
+	}
+
+	if d.manifest != nil {
+		if e, ok := d.manifest.lookup(pieceCid); ok {
+			return e.FilePath
+		}
+	}
+
+	var candidates []string
+	for _, dir := range d.dirs() {
+		for _, t := range d.templates() {
+			path := filepath.Join(dir, t.expand(pieceCid))
+			if found, ok := existingVariant(path); ok {
+				return found
+			}
+			candidates = append(candidates, path)
+		}
+	}
+
+	if d.Recursive {
+		for _, name := range withCompressed(pieceCid + ".car") {
+			if path, ok := d.findIndexed(name); ok {
+				return path
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[0]
 }
 
-// Get deals that are already imported/completed and save them
-// Will only execute once - returns immediately if the list is already populated
-func (d *Dataset) PopulateAlreadyImportedCids(boost *svc.BoostConnection) {
-	// Only populate once
-	if len(d.alreadyImportedCids) != 0 {
-		return
+// Returns true if the carfile exists. Remote carfiles are assumed to exist until they are fetched
+func (d *Dataset) carFileExists(path string) bool {
+	if d.Source != nil && util.IsURL(path) {
+		return true
 	}
+	return util.FileExists(path)
+}
 
-	var completedDeals svc.BoostDeals
+// The path of a carfile, followed by the paths of its compressed variants
+func withCompressed(path string) []string {
+	paths := []string{path}
+	for _, ext := range util.CompressedCarExtensions {
+		paths = append(paths, path+ext)
+	}
+	return paths
+}
 
-	for _, addr := range d.Addresses {
-		cd := boost.GetDealsCompleted(addr)
-		completedDeals = append(completedDeals, cd...)
+// Returns the carfile at path, or a compressed variant of it, if one exists
+func existingVariant(path string) (string, bool) {
+	for _, p := range withCompressed(path) {
+		if util.FileExists(p) {
+			return p, true
+		}
+	}
+	return "", false
+}
 
+// Look up a carfile by name in a search of the dataset's dirs, searching again if the last search is older than CAR_INDEX_TTL
+func (d *Dataset) findIndexed(name string) (string, bool) {
+	if d.index == nil {
+		d.index = &carFileIndex{}
 	}
-	log.Debugf("found %d completed deals for dataset %s", len(completedDeals), d.Dataset)
+	d.index.mu.Lock()
+	defer d.index.mu.Unlock()
 
-	for _, deal := range completedDeals {
-		d.alreadyImportedCids[deal.PieceCid] = true
+	if d.index.paths == nil || now().Sub(d.index.built) > CAR_INDEX_TTL {
+		d.index.paths = make(map[string]string)
+		for _, path := range d.CarFilePaths() {
+			if _, exists := d.index.paths[filepath.Base(path)]; !exists {
+				d.index.paths[filepath.Base(path)] = path
+			}
+		}
+		d.index.built = now()
 	}
 
-	inProgressDeals := boost.GetDealsInPipeline()
+	path, ok := d.index.paths[name]
+	return path, ok
+}
+
+// Get deals that are already imported/completed and save them
+// Will only execute once - returns immediately if the list is already populated
+// A caller that arrives while the list is being populated waits for it. If Boost can't be read, the list is left empty to try again
+func (d *Dataset) PopulateAlreadyImportedCids(boost svc.BoostClient, book AddressBook) error {
+	imported := d.alreadyImportedCids
+	imported.mu.Lock()
+	defer imported.mu.Unlock()
+
+	// Only populate once
+	if len(imported.cids) != 0 {
+		return nil
+	}
+
+	// Completed deals are streamed a page at a time, as there can be far more of them than are worth holding in memory
+	cids := make(map[string]bool)
+	completed := 0
+	for _, addr := range book.resolve(d.Addresses) {
+		err := boost.EachDealCompleted(addr, func(deal svc.Deal) {
+			cids[deal.PieceCid] = true
+			completed++
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.Debugf("found %d completed deals for dataset %s", completed, d.Dataset)
+
+	inProgressDeals, err := boost.GetDealsInPipeline()
+	if err != nil {
+		return err
+	}
 	log.Debugf("found %d in-progress deals", len(inProgressDeals))
 	for _, deal := range inProgressDeals {
-		d.alreadyImportedCids[deal.PieceCid] = true
+		cids[deal.PieceCid] = true
 	}
+
+	imported.cids = cids
+	return nil
 }
 
 func (d *Dataset) IsCidAlreadyImported(pieceCid string) bool {
-	_, exists := d.alreadyImportedCids[pieceCid]
-	return exists
+	d.alreadyImportedCids.mu.Lock()
+	defer d.alreadyImportedCids.mu.Unlock()
+	return d.alreadyImportedCids.cids[pieceCid]
 }
@@ -0,0 +1,120 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// Wait for writes to settle before reloading, as editors often save a file in several steps
+const DATASETS_RELOAD_DEBOUNCE = 500 * time.Millisecond
+
+// DatasetStore holds the current set of datasets, and reloads them when the datasets file changes
+type DatasetStore struct {
+	fileName string
+	mu       sync.RWMutex
+	datasets []Dataset
+}
+
+func NewDatasetStore(fileName string) *DatasetStore {
+	return &DatasetStore{
+		fileName: fileName,
+		datasets: ReadInDatasetsFromFile(fileName),
+	}
+}
+
+// Datasets returns the current datasets, in file order. The slice is replaced, not modified, on reload,
+// so callers can safely use it for the duration of an importer cycle
+func (s *DatasetStore) Datasets() []Dataset {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.datasets
+}
+
+// Reload re-reads the datasets file and swaps it in if it is valid
+// If it is invalid, the previous datasets are kept
+func (s *DatasetStore) Reload() {
+	ds, err := LoadDatasetsFromFile(s.fileName)
+	if err != nil {
+		log.Errorf("not reloading datasets, keeping previous config: %s", err)
+		return
+	}
+
+	s.mu.Lock()
+	s.datasets = ds
+	s.mu.Unlock()
+
+	log.Infof("reloaded %d datasets from %s", len(ds), s.fileName)
+	log.Debugf("datasets: %+v", ds)
+}
+
+// Watch reloads the datasets file whenever it changes on disk, or when the process receives SIGHUP
+// Blocks until ctx is cancelled, so should be run in its own goroutine
+func (s *DatasetStore) Watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// Watch the directory rather than the file, so that the watch survives the file being replaced (ie, by an editor or config management)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("could not create datasets file watcher, only SIGHUP will reload datasets: %s", err)
+	} else {
+		defer watcher.Close()
+		if err := watcher.Add(filepath.Dir(s.fileName)); err != nil {
+			log.Errorf("could not watch datasets file, only SIGHUP will reload datasets: %s", err)
+		}
+	}
+
+	var events chan fsnotify.Event
+	var errs chan error
+	if watcher != nil {
+		events = watcher.Events
+		errs = watcher.Errors
+	}
+
+	debounce := time.NewTimer(DATASETS_RELOAD_DEBOUNCE)
+	debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Infof("received SIGHUP, reloading datasets")
+			s.Reload()
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if filepath.Clean(ev.Name) != filepath.Clean(s.fileName) || ev.Op == fsnotify.Chmod {
+				continue
+			}
+			log.Debugf("datasets file changed (%s)", ev.Op)
+			// Drain a timer that has fired but not yet been received, so it doesn't trigger an extra reload
+			if !debounce.Stop() {
+				select {
+				case <-debounce.C:
+				default:
+				}
+			}
+			debounce.Reset(DATASETS_RELOAD_DEBOUNCE)
+		case <-debounce.C:
+			s.Reload()
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			log.Errorf("datasets file watcher error: %s", err)
+		}
+	}
+}
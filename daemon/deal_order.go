@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"sort"
+	"time"
+
+	svc "github.com/application-research/delta-importer/services"
+)
+
+type DealOrder string
+
+const (
+	// Import the deal with the least slack first - the least time to spare between sealing completing and its start epoch
+	DealOrderUrgency DealOrder = "urgency"
+	// Import the oldest deal first
+	DealOrderFifo DealOrder = "fifo"
+	// Import the newest deal first
+	DealOrderLifo DealOrder = "lifo"
+	// Import the deal with the largest piece first
+	DealOrderLargest DealOrder = "largest"
+)
+
+func (o DealOrder) valid() bool {
+	switch o {
+	case DealOrderUrgency, DealOrderFifo, DealOrderLifo, DealOrderLargest:
+		return true
+	}
+	return false
+}
+
+// Sort deals awaiting import into the order they should be imported in
+// Boost returns deals newest first, so ties are broken oldest first (as the importer did before deals were ordered)
+func orderDeals(deals svc.BoostDeals, order DealOrder, at time.Time, sealing time.Duration) svc.BoostDeals {
+	sorted := make(svc.BoostDeals, 0, len(deals))
+	for i := len(deals) - 1; i >= 0; i-- {
+		sorted = append(sorted, deals[i])
+	}
+
+	switch order {
+	case DealOrderFifo:
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].CreatedAt.Before(sorted[j].CreatedAt)
+		})
+	case DealOrderLifo:
+		// Newest first, with ties in Boost's order
+		for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+			sorted[i], sorted[j] = sorted[j], sorted[i]
+		}
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].CreatedAt.After(sorted[j].CreatedAt)
+		})
+	case DealOrderLargest:
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].PieceSize.Uint64() > sorted[j].PieceSize.Uint64()
+		})
+	default:
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return dealSlack(sorted[i], at, sealing) < dealSlack(sorted[j], at, sealing)
+		})
+	}
+
+	return sorted
+}
+
+// Time to spare between sealing completing (if the deal was imported at `at` and takes `sealing` to reach proving) and the deal's start epoch
+// Negative if the deal would miss its start epoch
+func dealSlack(deal svc.Deal, at time.Time, sealing time.Duration) time.Duration {
+	return time.Unix(deal.StartEpoch.IntoUnix(), 0).Sub(at) - sealing
+}
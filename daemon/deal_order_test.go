@@ -0,0 +1,92 @@
+package daemon
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	svc "github.com/application-research/delta-importer/services"
+	"github.com/application-research/delta-importer/services/fakeboost"
+)
+
+func TestOrderDeals(t *testing.T) {
+	at := time.Now()
+	deal := func(name string, createdAgo time.Duration, size uint64, startIn time.Duration) svc.Deal {
+		return svc.Deal{
+			PieceCid:   name,
+			CreatedAt:  at.Add(-createdAgo),
+			PieceSize:  fakeboost.PieceSize(size),
+			StartEpoch: fakeboost.StartEpochAt(at.Add(startIn)),
+		}
+	}
+
+	// In Boost's order, newest first
+	deals := svc.BoostDeals{
+		deal("newest", time.Hour, 2<<30, 20*time.Hour),
+		deal("middle", 2*time.Hour, 4<<30, 5*time.Hour),
+		deal("oldest", 3*time.Hour, 1<<30, 10*time.Hour),
+	}
+	// Deals created at the same time, with the same size and start epoch
+	ties := svc.BoostDeals{
+		deal("tie-newer", time.Hour, 1<<30, 10*time.Hour),
+		deal("tie-older", time.Hour, 1<<30, 10*time.Hour),
+	}
+
+	cases := []struct {
+		name     string
+		deals    svc.BoostDeals
+		order    DealOrder
+		sealing  time.Duration
+		expected string
+	}{
+		{"urgency", deals, DealOrderUrgency, time.Hour, "middle oldest newest"},
+		{"fifo", deals, DealOrderFifo, time.Hour, "oldest middle newest"},
+		{"lifo", deals, DealOrderLifo, time.Hour, "newest middle oldest"},
+		{"largest", deals, DealOrderLargest, time.Hour, "middle newest oldest"},
+		{"urgency ties are oldest first", ties, DealOrderUrgency, time.Hour, "tie-older tie-newer"},
+		{"fifo ties are oldest first", ties, DealOrderFifo, time.Hour, "tie-older tie-newer"},
+		{"lifo ties are newest first", ties, DealOrderLifo, time.Hour, "tie-newer tie-older"},
+		{"largest ties are oldest first", ties, DealOrderLargest, time.Hour, "tie-older tie-newer"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var order []string
+			for _, d := range orderDeals(c.deals, c.order, at, c.sealing) {
+				order = append(order, d.PieceCid)
+			}
+			if got := strings.Join(order, " "); got != c.expected {
+				t.Errorf("expected %q, got %q", c.expected, got)
+			}
+		})
+	}
+
+	// Sorting doesn't reorder the deals passed in
+	if deals[0].PieceCid != "newest" || deals[2].PieceCid != "oldest" {
+		t.Errorf("expected the deals passed in to keep their order, got %v", deals)
+	}
+}
+
+func TestDealSlack(t *testing.T) {
+	at := time.Now().Truncate(time.Minute)
+	d := svc.Deal{StartEpoch: fakeboost.StartEpochAt(at.Add(10 * time.Hour))}
+
+	cases := []struct {
+		name     string
+		sealing  time.Duration
+		expected time.Duration
+	}{
+		{"time to spare", 4 * time.Hour, 6 * time.Hour},
+		{"no time to spare", 10 * time.Hour, 0},
+		{"misses start epoch", 12 * time.Hour, -2 * time.Hour},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Epochs are 30 seconds apart, so the start epoch can be up to 30 seconds off
+			if got := dealSlack(d, at, c.sealing); got > c.expected || got <= c.expected-30*time.Second {
+				t.Errorf("expected %s, got %s", c.expected, got)
+			}
+		})
+	}
+}
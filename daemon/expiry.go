@@ -0,0 +1,142 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/application-research/delta-importer/db"
+	svc "github.com/application-research/delta-importer/services"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often deals awaiting import are checked for ones that can no longer make their start epoch
+const EXPIRY_CHECK_INTERVAL = time.Duration(15 * time.Minute)
+
+// expiryChecker finds offline deals awaiting import that can no longer be sealed before their start epoch, and records them in the db
+// It warns (once per deal) when a deal is within the warning window of becoming infeasible, while there is still time to import it
+type expiryChecker struct {
+	cfg      Config
+	db       *db.DIDB
+	pace     *pacer
+	datasets *DatasetStore
+	warning  time.Duration // How long before a deal becomes infeasible to warn about it (0 = no warnings)
+	warned   map[string]bool
+}
+
+func newExpiryChecker(cfg Config, db *db.DIDB, pace *pacer, datasets *DatasetStore) *expiryChecker {
+	return &expiryChecker{
+		cfg:      cfg,
+		db:       db,
+		pace:     pace,
+		datasets: datasets,
+		warning:  time.Hour * time.Duration(cfg.ExpiryWarning),
+		warned:   make(map[string]bool),
+	}
+}
+
+// Run checks deals periodically until ctx is cancelled
+func (x *expiryChecker) Run(ctx context.Context) {
+	for {
+		x.check()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(EXPIRY_CHECK_INTERVAL):
+		}
+	}
+}
+
+func (x *expiryChecker) check() {
+	boost, err := newBoostClient(x.cfg, nil)
+	if err != nil {
+		log.Errorf("error creating boost connection for expiry check: %s", err.Error())
+		return
+	}
+	defer boost.Close()
+
+	depth, throughput := x.pace.pipeline()
+	sealing := estimateSealing(x.db, depth, throughput, time.Minute*time.Duration(x.cfg.SealingMargin))
+
+	awaiting := make(map[string]bool)
+	for _, ds := range x.datasets.Datasets() {
+		deals, err := boost.GetDealsAwaitingImport(x.cfg.addressBook.resolve(ds.Addresses))
+		if err != nil {
+			// Without every deal awaiting import, the ones no longer awaiting can't be told apart - try again next check
+			log.Errorf("skipping expiry check: %s", err)
+			return
+		}
+		for _, deal := range deals {
+			// A deal matching more than one dataset is reported for the first
+			if awaiting[deal.ID] {
+				continue
+			}
+			awaiting[deal.ID] = true
+			x.checkDeal(ds.Dataset, deal, sealing)
+		}
+	}
+
+	// Deals no longer awaiting import (imported, or gone from Boost) can't miss their start epoch, so stop reporting them
+	expiring, err := x.db.GetExpiringDeals("")
+	if err != nil {
+		log.Errorf("could not get expiring deals: %s", err)
+	}
+	for _, e := range expiring {
+		if awaiting[e.DealUuid] {
+			continue
+		}
+		if err := x.db.RemoveExpiringDeal(e.DealUuid); err != nil {
+			log.Errorf("could not remove expiring deal %s: %s", e.DealUuid, err)
+		}
+	}
+	for id := range x.warned {
+		if !awaiting[id] {
+			delete(x.warned, id)
+		}
+	}
+}
+
+func (x *expiryChecker) checkDeal(dataset string, deal svc.Deal, sealing sealingEstimate) {
+	at := now()
+	start := time.Unix(deal.StartEpoch.IntoUnix(), 0)
+	epoch, _ := strconv.ParseInt(deal.StartEpoch.Value, 10, 64)
+	// The last time the deal can be imported and still be expected to reach proving, with the margin to spare, before its start epoch
+	infeasibleAt := start.Add(-(sealing.duration + sealing.margin))
+
+	if sealing.feasible(deal, at) {
+		// The deal may have been infeasible before, while the pipeline was deeper
+		if err := x.db.RemoveExpiringDeal(deal.ID); err != nil {
+			log.Errorf("could not update expiring deal %s: %s", deal.ID, err)
+		}
+
+		if x.warning != 0 && !x.warned[deal.ID] && !at.Before(infeasibleAt.Add(-x.warning)) {
+			log.Warnf("deal %s (piece %s, dataset %s) must be imported in the next %s, or it will not reach proving before its start epoch at %s",
+				deal.ID, deal.PieceCid, dataset, infeasibleAt.Sub(at).Round(time.Minute), start.Format(time.RFC3339))
+			x.warned[deal.ID] = true
+		}
+		return
+	}
+
+	reason := fmt.Sprintf("start epoch would pass before sealing completes (expected to take %s, with a %s margin)", sealing.duration.Round(time.Minute), sealing.margin)
+	if !start.After(at) {
+		reason = "start epoch has passed"
+	}
+
+	log.Debugf("deal %s for dataset %s can no longer make its start epoch: %s", deal.ID, dataset, reason)
+	err := x.db.RecordExpiringDeal(db.ExpiringDeal{
+		DealUuid:      deal.ID,
+		PieceCid:      deal.PieceCid,
+		Dataset:       dataset,
+		ClientAddress: deal.ClientAddress,
+		StartEpoch:    epoch,
+		StartTime:     start,
+		Reason:        reason,
+		FirstSeen:     at,
+		LastSeen:      at,
+	})
+	if err != nil {
+		log.Errorf("could not record expiring deal %s: %s", deal.ID, err)
+	}
+}
@@ -0,0 +1,82 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/application-research/delta-importer/db"
+	svc "github.com/application-research/delta-importer/services"
+	"github.com/application-research/delta-importer/services/fakeboost"
+	"github.com/google/uuid"
+)
+
+// Deals that can't make their start epoch are recorded, and removed once they are no longer awaiting import - but not while Boost can't be read
+func TestExpiryCheck(t *testing.T) {
+	fb, err := fakeboost.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Close()
+
+	id := uuid.New().String()
+	fb.AddDeal(svc.Deal{
+		ID:            id,
+		PieceCid:      "baga-too-late",
+		IsOffline:     true,
+		ClientAddress: "f1aaa",
+		PieceSize:     fakeboost.PieceSize(1 << 20),
+		Checkpoint:    "Accepted",
+		StartEpoch:    fakeboost.StartEpochAt(time.Now().Add(time.Hour)),
+	})
+
+	dataDir := t.TempDir()
+	datasetsFile := filepath.Join(dataDir, "datasets.json")
+	if err := os.WriteFile(datasetsFile, []byte(`[{"dataset": "test", "address": ["f1aaa"], "dir": "`+dataDir+`"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		BoostAddress:  fb.Address(),
+		BoostPort:     fb.Port(),
+		BoostGqlPort:  fb.Port(),
+		BoostAPIKey:   "test",
+		SealingMargin: 30,
+		Interval:      60,
+		Pacing:        PacingFixed,
+	}
+	didb, err := db.OpenDIDB(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer didb.Close()
+
+	x := newExpiryChecker(cfg, didb, newPacer(cfg, didb), NewDatasetStore(datasetsFile))
+	expiring := func() []db.ExpiringDeal {
+		deals, err := didb.GetExpiringDeals("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return deals
+	}
+
+	x.check()
+	if deals := expiring(); len(deals) != 1 || deals[0].DealUuid != id || deals[0].Dataset != "test" {
+		t.Fatalf("expected deal %s to be recorded as expiring, got %+v", id, deals)
+	}
+
+	// The deal is imported, but Boost can't be reached to see it
+	fb.UpdateDeal(id, func(d *svc.Deal) { d.InboundFilePath = "/staging/baga-too-late.car" })
+	x.cfg.BoostGqlPort = "1"
+	x.check()
+	if deals := expiring(); len(deals) != 1 {
+		t.Errorf("expected the expiring deal to be kept while boost can't be read, got %+v", deals)
+	}
+
+	x.cfg.BoostGqlPort = fb.Port()
+	x.check()
+	if deals := expiring(); len(deals) != 0 {
+		t.Errorf("expected the imported deal to be removed, got %+v", deals)
+	}
+}
@@ -0,0 +1,334 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	svc "github.com/application-research/delta-importer/services"
+	util "github.com/application-research/delta-importer/util"
+	log "github.com/sirupsen/logrus"
+)
+
+type SourceType string
+
+const (
+	// Carfiles are downloaded over http(s) into the staging dir
+	SourceHttp SourceType = "http"
+)
+
+// Timeouts for carfile downloads. There is no overall timeout, as a large carfile can take hours to download,
+// so a download that stops receiving data is cancelled after HTTP_STALL_TIMEOUT instead
+const (
+	HTTP_DIAL_TIMEOUT            = time.Duration(30 * time.Second)
+	HTTP_RESPONSE_HEADER_TIMEOUT = time.Duration(1 * time.Minute)
+	HTTP_IDLE_CONN_TIMEOUT       = time.Duration(90 * time.Second)
+	HTTP_STALL_TIMEOUT           = time.Duration(2 * time.Minute)
+)
+
+// Shared by every import cycle, so connections to a source are reused
+var httpSourceClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: HTTP_DIAL_TIMEOUT, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   HTTP_DIAL_TIMEOUT,
+		ResponseHeaderTimeout: HTTP_RESPONSE_HEADER_TIMEOUT,
+		IdleConnTimeout:       HTTP_IDLE_CONN_TIMEOUT,
+	},
+}
+
+// Where a dataset's carfiles are fetched from, if they aren't on a local filesystem
+type DatasetSource struct {
+	Type    SourceType        `json:"type"`
+	URL     string            `json:"url"`               // URL template, ex. https://host/{piece_cid}.car
+	Headers map[string]string `json:"headers,omitempty"` // Sent with each request, ex. Authorization. Environment variables in values are expanded
+}
+
+func (s *DatasetSource) validate() error {
+	if s.Type != SourceHttp {
+		return fmt.Errorf("unsupported source type '%s' - must be http", s.Type)
+	}
+
+	t := shardTemplate(s.URL)
+	if !reShardPlaceholder.MatchString(s.URL) || strings.ContainsAny(reShardPlaceholder.ReplaceAllString(s.URL, ""), "{}") {
+		return fmt.Errorf("source url %q must contain {piece_cid}, and no other placeholders", s.URL)
+	}
+	u, err := url.Parse(t.expand("baga"))
+	if err != nil {
+		return fmt.Errorf("invalid source url %q: %w", s.URL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("source url %q must be an http or https url", s.URL)
+	}
+
+	return nil
+}
+
+// The URL to fetch the carfile for a piece cid from
+func (s *DatasetSource) url(pieceCid string) string {
+	return shardTemplate(s.URL).expand(pieceCid)
+}
+
+func (s *DatasetSource) header() http.Header {
+	h := make(http.Header)
+	for k, v := range s.Headers {
+		h.Set(k, os.ExpandEnv(v))
+	}
+	return h
+}
+
+// httpFetcher downloads carfiles for datasets with an http source into the staging dir before they are imported
+// Partial downloads are kept (as <file>.part), and resumed with a Range request on the next attempt
+type httpFetcher struct {
+	staging *svc.Staging
+	client  *http.Client
+	sources map[string]*DatasetSource
+}
+
+func newHttpFetcher(staging *svc.Staging, datasets []Dataset) httpFetcher {
+	f := httpFetcher{staging: staging, client: httpSourceClient, sources: make(map[string]*DatasetSource)}
+	for _, ds := range datasets {
+		if ds.Source != nil && ds.Source.Type == SourceHttp {
+			f.sources[ds.Dataset] = ds.Source
+		}
+	}
+	return f
+}
+
+// True if any dataset has an http source
+func (f httpFetcher) enabled() bool {
+	return len(f.sources) > 0
+}
+
+// Pre-import step that downloads a remote carfile into the staging dir, and points the job at the downloaded file
+func (f httpFetcher) fetch(ctx context.Context, job *importJob) error {
+	source, ok := f.sources[job.dataset]
+	if !ok || !util.IsURL(job.carFile) {
+		return nil
+	}
+	if f.staging == nil {
+		return errors.New("carfiles from an http source can only be imported with a staging dir")
+	}
+
+	// Keep the compression extension, so a compressed carfile is decompressed when it is staged
+	name := job.pieceCid + ".car"
+	if u, err := url.Parse(job.carFile); err == nil && util.IsCompressed(u.Path) {
+		name += path.Ext(u.Path)
+	}
+
+	// The most data the deal's piece can hold. Compressed carfiles can't be checked until they are decompressed
+	maxSize := int64(-1)
+	if job.pieceSize > 0 && !util.IsCompressed(name) {
+		maxSize = int64(job.pieceSize - job.pieceSize/128)
+	}
+
+	dst, found := f.previousDownload(name)
+	if found {
+		log.Debugf("using previously downloaded %s", dst)
+	} else {
+		dir, release, err := f.place(name, job.pieceSize)
+		if err != nil {
+			return fmt.Errorf("could not download %s: %w", job.carFile, err)
+		}
+		dst = filepath.Join(dir, name)
+		log.Infof("downloading %s to %s", job.carFile, dst)
+		err = f.download(ctx, job.carFile, source.header(), dst, maxSize)
+		release(err == nil)
+		if err != nil {
+			return fmt.Errorf("could not download %s: %w", job.carFile, err)
+		}
+	}
+
+	job.carFile = dst
+	job.fileSize = util.FileSize(dst)
+	job.fetched = true
+	return nil
+}
+
+// Pick the staging dir to download name into, reserving room for the piece
+// A partial download is resumed where it is if its dir has room for the rest, otherwise it is removed and started again
+func (f httpFetcher) place(name string, pieceSize uint64) (string, func(ok bool), error) {
+	if part, found := f.previousDownload(name + ".part"); found {
+		remaining := pieceSize
+		if size := uint64(util.FileSize(part)); size < remaining {
+			remaining -= size
+		} else {
+			remaining = 0
+		}
+
+		dir := filepath.Dir(part)
+		release, err := f.staging.PlaceIn(dir, remaining)
+		if err == nil {
+			return dir, release, nil
+		}
+		log.Warnf("can't resume download of %s: %s. starting again", part, err)
+		os.Remove(part)
+	}
+
+	return f.staging.Place(pieceSize)
+}
+
+// Find a file downloaded (or partly downloaded) into any of the staging dirs
+func (f httpFetcher) previousDownload(name string) (string, bool) {
+	for _, dir := range f.staging.Dirs() {
+		if path := filepath.Join(dir, name); util.FileExists(path) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// Download url to dst, resuming from dst.part if a previous download was interrupted
+// Fails if the file is larger than maxSize (-1 = no limit), or the server sends less than it said it would
+func (f httpFetcher) download(ctx context.Context, url string, header http.Header, dst string, maxSize int64) error {
+	part := dst + ".part"
+	var offset int64
+	if fi, err := os.Stat(part); err == nil {
+		offset = fi.Size()
+	}
+
+	// Cancelled if the server stops sending data for HTTP_STALL_TIMEOUT
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = header.Clone()
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Total size of the file, or -1 if the server didn't say
+	total := int64(-1)
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Server ignored the range (or there was no partial download) - start again
+		offset = 0
+		total = resp.ContentLength
+		flags |= os.O_TRUNC
+	case http.StatusPartialContent:
+		start, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		if start != offset {
+			return fmt.Errorf("server resumed from byte %d, expected %d", start, offset)
+		}
+		log.Infof("resuming download of %s from byte %d", url, offset)
+		total = size
+		flags |= os.O_APPEND
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial download may already be complete
+		_, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || size != offset {
+			os.Remove(part)
+			return fmt.Errorf("could not resume download from byte %d, it will be restarted", offset)
+		}
+		if maxSize >= 0 && offset > maxSize {
+			os.Remove(part)
+			return fmt.Errorf("file is %d bytes, larger than the deal's piece can hold (%d bytes)", offset, maxSize)
+		}
+		return os.Rename(part, dst)
+	default:
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+
+	if maxSize >= 0 && total > maxSize {
+		return fmt.Errorf("file is %d bytes, larger than the deal's piece can hold (%d bytes)", total, maxSize)
+	}
+
+	out, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return err
+	}
+	stall := time.AfterFunc(HTTP_STALL_TIMEOUT, cancel)
+	written, err := io.Copy(out, stallReader{r: resp.Body, timer: stall})
+	stall.Stop()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil && reqCtx.Err() != nil && ctx.Err() == nil {
+		err = fmt.Errorf("no data received for %s", HTTP_STALL_TIMEOUT)
+	}
+	if err != nil {
+		// Keep what was downloaded, to resume from next time
+		return fmt.Errorf("download interrupted after %d bytes: %w", offset+written, err)
+	}
+
+	size := offset + written
+	if total >= 0 && size != total {
+		return fmt.Errorf("downloaded %d bytes, but the server said the file is %d bytes", size, total)
+	}
+	if maxSize >= 0 && size > maxSize {
+		os.Remove(part)
+		return fmt.Errorf("file is %d bytes, larger than the deal's piece can hold (%d bytes)", size, maxSize)
+	}
+
+	return os.Rename(part, dst)
+}
+
+// stallReader restarts timer each time data is read, so it only fires once reads have stalled
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (s stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.timer.Reset(HTTP_STALL_TIMEOUT)
+	}
+	return n, err
+}
+
+// Parse a Content-Range header (ex. "bytes 100-199/1000" or "bytes */1000"), returning the start of the range and the total size (-1 if unknown)
+func parseContentRange(header string) (int64, int64, error) {
+	rest, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	rng, size, ok := strings.Cut(rest, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	total := int64(-1)
+	if size != "*" {
+		t, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+		}
+		total = t
+	}
+
+	var start int64
+	if rng != "*" {
+		s, _, _ := strings.Cut(rng, "-")
+		var err error
+		start, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+		}
+	}
+
+	return start, total, nil
+}
@@ -0,0 +1,165 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	svc "github.com/application-research/delta-importer/services"
+)
+
+const testPieceCid = "baga6ea4seaqtest"
+
+// A carfile server that records the Range header of each request
+type testCarServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	ranges []string
+}
+
+func newTestCarServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) *testCarServer {
+	s := &testCarServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.mu.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Serves content with Range support
+func serveContent(content []byte) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}
+}
+
+func newTestFetcher(t *testing.T, url string) (httpFetcher, string, *importJob) {
+	dir := t.TempDir()
+	staging := svc.NewStaging([]string{dir}, 0, svc.StagingMostFree, svc.StagingCopy, 0, false)
+	ds := Dataset{Dataset: "test", Source: &DatasetSource{Type: SourceHttp, URL: url + "/{piece_cid}.car"}}
+	job := &importJob{dataset: "test", carFile: ds.Source.url(testPieceCid), pieceCid: testPieceCid, pieceSize: 1 << 20}
+	return newHttpFetcher(staging, []Dataset{ds}), dir, job
+}
+
+func TestHttpFetchDownloadsCarFile(t *testing.T) {
+	content := bytes.Repeat([]byte("car data "), 1000)
+	srv := newTestCarServer(t, serveContent(content))
+	f, dir, job := newTestFetcher(t, srv.URL)
+
+	if err := f.fetch(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, testPieceCid+".car")
+	if job.carFile != dst || !job.fetched || job.fileSize != int64(len(content)) {
+		t.Errorf("job not pointed at the download: %+v", job)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("downloaded %d bytes, not the %d served", len(got), len(content))
+	}
+	if _, err := os.Stat(dst + ".part"); !os.IsNotExist(err) {
+		t.Errorf("partial download left behind")
+	}
+}
+
+func TestHttpFetchResumesPartialDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	srv := newTestCarServer(t, serveContent(content))
+	f, dir, job := newTestFetcher(t, srv.URL)
+
+	part := filepath.Join(dir, testPieceCid+".car.part")
+	if err := os.WriteFile(part, content[:4000], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.fetch(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(srv.ranges) != 1 || srv.ranges[0] != "bytes=4000-" {
+		t.Errorf("expected a single request for bytes=4000-, got %q", srv.ranges)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, testPieceCid+".car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("resumed download doesn't match the served file")
+	}
+}
+
+func TestHttpFetchFailsOnSizeMismatch(t *testing.T) {
+	t.Run("shorter than content-length", func(t *testing.T) {
+		srv := newTestCarServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "2000")
+			w.Write(bytes.Repeat([]byte("x"), 1000))
+		})
+		f, dir, job := newTestFetcher(t, srv.URL)
+
+		if err := f.fetch(context.Background(), job); err == nil {
+			t.Fatal("expected a truncated download to fail")
+		}
+		if _, err := os.Stat(filepath.Join(dir, testPieceCid+".car")); !os.IsNotExist(err) {
+			t.Errorf("truncated download was used as the carfile")
+		}
+		// What was received is kept to resume from
+		if fi, err := os.Stat(filepath.Join(dir, testPieceCid+".car.part")); err != nil || fi.Size() != 1000 {
+			t.Errorf("expected the 1000 bytes received to be kept, got %v %v", fi, err)
+		}
+	})
+
+	t.Run("larger than the piece", func(t *testing.T) {
+		srv := newTestCarServer(t, serveContent(bytes.Repeat([]byte("x"), 2000)))
+		f, dir, job := newTestFetcher(t, srv.URL)
+		job.pieceSize = 1024
+
+		err := f.fetch(context.Background(), job)
+		if err == nil || !strings.Contains(err.Error(), "larger than the deal's piece") {
+			t.Fatalf("expected an oversized carfile to fail, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, testPieceCid+".car")); !os.IsNotExist(err) {
+			t.Errorf("oversized carfile was used")
+		}
+	})
+
+	t.Run("complete partial download larger than the piece", func(t *testing.T) {
+		content := bytes.Repeat([]byte("x"), 2000)
+		srv := newTestCarServer(t, serveContent(content))
+		f, dir, job := newTestFetcher(t, srv.URL)
+		job.pieceSize = 1024
+
+		// Left by an earlier run, the server answers 416 as there is nothing more to send
+		part := filepath.Join(dir, testPieceCid+".car.part")
+		if err := os.WriteFile(part, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		err := f.fetch(context.Background(), job)
+		if err == nil || !strings.Contains(err.Error(), "larger than the deal's piece") {
+			t.Fatalf("expected an oversized partial download to fail, got %v", err)
+		}
+		if len(srv.ranges) != 1 || srv.ranges[0] != "bytes=2000-" {
+			t.Errorf("expected a single request for bytes=2000-, got %q", srv.ranges)
+		}
+		if _, err := os.Stat(filepath.Join(dir, testPieceCid+".car")); !os.IsNotExist(err) {
+			t.Errorf("oversized partial download was used")
+		}
+		if _, err := os.Stat(part); !os.IsNotExist(err) {
+			t.Errorf("oversized partial download was kept")
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package daemon
+
+import (
+	"context"
+	"sync"
+
+	svc "github.com/application-research/delta-importer/services"
+	util "github.com/application-research/delta-importer/util"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// A deal that has been matched to a carfile and is ready to import into Boost
+type importJob struct {
+	dataset   string
+	carFile   string
+	pieceCid  string
+	pieceSize uint64 // Padded piece size of the deal, if known
+	dealUuid  uuid.UUID
+	fileSize  int64 // Size of the carfile when it was queued
+	fetched   bool  // The carfile was downloaded into the staging dir by a pre-import step
+	// CID the import attempt is tracked under - the CID of the carfile in pull-cid mode, otherwise the piece CID
+	attemptCid string
+}
+
+// importQueue hands import jobs to a bounded pool of workers, up to a maximum number of jobs per cycle
+type importQueue struct {
+	remaining int
+	// Maximum number of jobs the dataset currently being searched may add - set by the scheduler
+	datasetLimit int
+	// Per-dataset limits for the dataset currently being searched
+	budget   *datasetBudget
+	jobs     chan importJob
+	shutdown <-chan struct{}
+	wg       sync.WaitGroup
+}
+
+// A step run by the import worker before a carfile is imported, ex. fetching or verifying it. Steps may update the job
+// Returning an error fails the import with the error as the reason
+type preImportStep func(ctx context.Context, job *importJob) error
+
+// Start workers to import up to limit jobs. Each result is passed to onResult with its job, one at a time
+func newImportQueue(ctx context.Context, boost svc.BoostClient, limit int, parallelism int, shutdown <-chan struct{}, steps []preImportStep, onResult func(importJob, svc.ImportResult)) *importQueue {
+	q := &importQueue{
+		remaining:    limit,
+		datasetLimit: limit,
+		jobs:         make(chan importJob),
+		shutdown:     shutdown,
+	}
+
+	type jobResult struct {
+		job importJob
+		res svc.ImportResult
+	}
+	results := make(chan jobResult)
+	var workers sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range q.jobs {
+				log.Debugf("importing deal %s for dataset %s", job.dealUuid, job.dataset)
+				if err := runSteps(ctx, steps, &job); err != nil {
+					log.Errorf("not importing deal %s: %s", job.dealUuid, err)
+					// Don't leave a downloaded carfile (that may be bad) in the staging dir
+					if job.fetched && util.FileExists(job.carFile) {
+						if err := util.DeleteFile(job.carFile); err != nil {
+							log.Errorf("failed to delete staged car file: %s", err)
+						}
+					}
+					results <- jobResult{job, svc.ImportResult{
+						Successful: false,
+						DealUuid:   job.dealUuid.String(),
+						CommP:      job.pieceCid,
+						FileSize:   job.fileSize,
+						Message:    err.Error(),
+					}}
+					continue
+				}
+				results <- jobResult{job, boost.ImportCar(ctx, job.carFile, job.pieceCid, job.dealUuid)}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		for r := range results {
+			onResult(r.job, r.res)
+		}
+	}()
+
+	return q
+}
+
+func runSteps(ctx context.Context, steps []preImportStep, job *importJob) error {
+	for _, step := range steps {
+		if err := step(ctx, job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns true once no more jobs should be added this cycle - either the limit has been reached or we are shutting down
+func (q *importQueue) done() bool {
+	select {
+	case <-q.shutdown:
+		return true
+	default:
+	}
+	return q.remaining <= 0
+}
+
+// Returns true once no more jobs should be added for the current dataset
+func (q *importQueue) full() bool {
+	return q.done() || q.datasetLimit <= 0 || q.budget.exhausted() != ""
+}
+
+// Queue a job for import. Blocks until a worker is free to take it
+func (q *importQueue) add(job importJob) {
+	q.remaining--
+	q.datasetLimit--
+	// Remote carfiles aren't downloaded yet
+	if !util.IsURL(job.carFile) {
+		job.fileSize = util.FileSize(job.carFile)
+	}
+	// Counted by the deal's padded piece size, the unit of the dataset's byte limits - carfile sizes vary with padding and compression
+	q.budget.add(int64(job.pieceSize))
+	q.jobs <- job
+}
+
+// Wait for all queued jobs to complete and their results to be handled
+func (q *importQueue) wait() {
+	close(q.jobs)
+	q.wg.Wait()
+}
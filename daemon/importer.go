@@ -6,212 +6,331 @@ import (
 
 	"github.com/application-research/delta-importer/db"
 	svc "github.com/application-research/delta-importer/services"
-	util "github.com/application-research/delta-importer/util"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
-func importer(cfg Config, db *db.DIDB, datasets map[string]Dataset) {
+// Runs a single import cycle
+// ctx is passed through to in-flight imports, and is only cancelled once the shutdown timeout has passed
+// Once shutdown is closed, no new imports will be started
+func importer(ctx context.Context, shutdown <-chan struct{}, cfg Config, db *db.DIDB, sched *Scheduler, pace *pacer, staging *svc.Staging, datasets []Dataset) {
 	// We construct a new Boost connection at each run of the importer, as this is resilient in case boost is down/restarts
 	// It will simply re-connect upon the next run of the importer
-	boost, err := svc.NewBoostConnection(cfg.BoostAddress, cfg.BoostPort, cfg.BoostGqlPort, cfg.BoostAPIKey, cfg.StagingDir, cfg.DeleteAfterImport)
+	boost, err := newBoostClient(cfg, staging)
 	if err != nil {
 		log.Errorf("error creating boost connection: %s", err.Error())
 		return
 	}
 	defer boost.Close()
 
-	inProgress := boost.GetDealsInPipeline()
+	inProgress, err := boost.GetDealsInPipeline()
+	if err != nil {
+		log.Errorf("skipping import job as the deals in the sealing pipeline could not be read: %s", err)
+		return
+	}
 
-	if cfg.MaxConcurrent != 0 && len(inProgress) >= int(cfg.MaxConcurrent) {
-		log.Infof("skipping import job as there are already %d deals in progress (max_concurrent is %d)", len(inProgress), cfg.MaxConcurrent)
+	maxDepth := pace.maxDepth()
+	if maxDepth != 0 && len(inProgress) >= int(maxDepth) {
+		log.Infof("skipping import job as there are already %d deals in progress (limit is %d)", len(inProgress), maxDepth)
+		pace.observe(len(inProgress), 0)
 		return
 	}
 
 	log.Debugf("found %d deals in sealing pipeline", len(inProgress))
 
-	var importResult *svc.ImportResult
+	// Don't use up attempts on imports that would fail to stage
+	if staging != nil && !staging.HasRoom() {
+		log.Warnf("skipping import job as no staging dir has free space above the %d GiB reserve", cfg.StagingReserve)
+		pace.observe(len(inProgress), 0)
+		return
+	}
+
+	limit := importLimit(maxDepth, pace.perCycle(), len(inProgress))
+	log.Debugf("importing up to %d deals this cycle", limit)
+
+	attempts := attemptTracker{db: db, cfg: cfg}
+	imported := 0
+
+	_, throughput := pace.pipeline()
+	sealing := estimateSealing(db, len(inProgress), throughput, time.Minute*time.Duration(cfg.SealingMargin))
+
+	// Remote carfiles are fetched first, so they can be checked like local ones. The manifest needs no carfile, so is checked before fetching
+	var steps []preImportStep
+	if checker := newManifestChecker(datasets); checker.enabled() {
+		steps = append(steps, checker.check)
+	}
+	if fetcher := newHttpFetcher(staging, datasets); fetcher.enabled() {
+		steps = append(steps, fetcher.fetch)
+	}
+	if validator := newCarValidator(datasets); validator.enabled() {
+		steps = append(steps, validator.check)
+	}
+	if cfg.VerifyCommP {
+		steps = append(steps, commpVerifier{db: db, quarantineDir: cfg.QuarantineDir}.check)
+	}
+
+	q := newImportQueue(ctx, boost, limit, int(cfg.ImportParallelism), shutdown, steps, func(job importJob, res svc.ImportResult) {
+		// Recorded with the deal's padded piece size, so daily quotas are counted in the same unit as the pipeline
+		err := db.InsertDeal(res.DealUuid, res.CommP, job.dataset, res.Successful, string(cfg.Mode), res.Message, int64(job.pieceSize), now())
+		if err != nil {
+			log.Errorf("error recording import of deal %s: %s", res.DealUuid, err)
+		}
+		if res.Successful {
+			imported++
+		} else {
+			attempts.failed(job.attemptCid, res.Message)
+		}
+	})
+
+	budgets := newDatasetBudgets(datasets, inProgress, cfg.addressBook, db)
 
-	// Attempt to import a deal for each dataset in order - if any dataset fails, go to the next one
-	for _, ds := range datasets {
-		log.Debugf("searching for a deal for dataset %s", ds.Dataset)
+	sched.fill(q, datasets, func(ds Dataset) int {
+		q.budget = budgets[ds.Dataset]
+		if reason := q.budget.exhausted(); reason != "" {
+			log.Infof("skipping dataset %s: %s", ds.Dataset, reason)
+			return 0
+		}
+
+		log.Debugf("searching for deals for dataset %s", ds.Dataset)
 
 		switch cfg.Mode {
 		case ModePullDataset:
-			importResult = importerPullDataset(cfg, ds, boost)
+			return importerPullDataset(ctx, cfg, ds, boost, q, attempts)
 		case ModePullCID:
-			importResult = importerPullCid(cfg, ds, boost)
+			return importerPullCid(ctx, cfg, ds, boost, q, attempts)
 		default:
-			importResult = importerDefault(cfg, ds, boost)
+			return importerDefault(ctx, cfg, ds, boost, q, attempts, sealing)
 		}
+	})
 
-		if importResult != nil {
-			db.InsertDeal(importResult.DealUuid, importResult.CommP, importResult.Successful, string(cfg.Mode), importResult.Message, importResult.FileSize)
-		}
+	select {
+	case <-shutdown:
+		log.Infof("shutting down, not starting any more imports")
+	default:
+	}
 
-		if importResult != nil && importResult.Successful {
-			break
-		}
+	q.wait()
+	pace.observe(len(inProgress), imported)
+}
+
+// Number of deals to import in a single cycle - the headroom below maxDepth (max_concurrent, or the adaptive pacing target), capped by maxPerCycle
+// If neither is set, one deal is imported per cycle
+func importLimit(maxDepth uint, maxPerCycle uint, inPipeline int) int {
+	limit := 0
+	if maxDepth != 0 {
+		limit = int(maxDepth) - inPipeline
+	}
+
+	if maxPerCycle != 0 && (limit == 0 || int(maxPerCycle) < limit) {
+		limit = int(maxPerCycle)
+	}
+
+	if maxDepth == 0 && maxPerCycle == 0 {
+		limit = 1
 	}
+
+	return limit
 }
 
-var cidsAlreadyAttempted = make(map[string]bool)
+// Current time used for start epoch checks. Replaced with an accelerated clock when simulating
+var now = time.Now
 
-func importerDefault(cfg Config, ds Dataset, boost *svc.BoostConnection) *svc.ImportResult {
-	toImport := boost.GetDealsAwaitingImport(ds.Addresses)
+// Queues deals awaiting import in Boost for the dataset, returning the number of deals queued
+func importerDefault(ctx context.Context, cfg Config, ds Dataset, boost svc.BoostClient, q *importQueue, attempts attemptTracker, sealing sealingEstimate) int {
+	toImport, err := boost.GetDealsAwaitingImport(cfg.addressBook.resolve(ds.Addresses))
+	if err != nil {
+		log.Errorf("skipping dataset %s : %s", ds.Dataset, err)
+		return 0
+	}
 
 	if len(toImport) == 0 {
 		log.Debugf("skipping dataset %s : no deals awaiting import", ds.Dataset)
-		return nil
+		return 0
 	}
 
 	log.Debugf("%d deals awaiting import for dataset %s", len(toImport), ds.Dataset)
 
-	// Start with the last (oldest) deal
-	i := len(toImport)
-	// keep trying until we successfully manage to import a deal
-	// this should usually simply take the first one, import it, and then return
-	for i > 0 {
-		i = i - 1
-		deal := toImport[i]
+	queued := 0
+
+	// keep going until we have filled the available import slots
+	for _, deal := range orderDeals(toImport, cfg.DealOrder, now(), sealing.duration) {
+		if q.full() {
+			break
+		}
 
-		// Don't attempt more than once
-		if cidsAlreadyAttempted[deal.PieceCid] {
+		// Don't retry until the backoff from the last attempt has passed
+		if !attempts.eligible(deal.PieceCid) {
 			continue
 		}
-		cidsAlreadyAttempted[deal.PieceCid] = true
 
-		if deal.StartEpoch.IntoUnix() < time.Now().Add(MIN_SEALING_TIME).Unix() {
-			log.Debugf("skipping deal %s as it would be past the start epoch when sealing completes", deal.ID)
+		// Not recorded as an attempt, as the deal may fit once the pipeline drains
+		if !sealing.feasible(deal, now()) {
+			log.Debugf("skipping deal %s this cycle as it would be past the start epoch when sealing completes", deal.ID)
 			continue
 		}
 
 		// See if we have failed this CID before with mismatched commP
-		otherDeals := boost.GetDealsForContent(deal.PieceCid)
+		otherDeals, err := boost.GetDealsForContent(deal.PieceCid)
+		if err != nil {
+			log.Errorf("could not check deals for %s, not importing any more deals for dataset %s: %s", deal.PieceCid, ds.Dataset, err)
+			return queued
+		}
 		if otherDeals.HasMismatchedCommPErrors() {
 			log.Debugf("skipping import of %s as there are mismatched CommP errors for it", deal.PieceCid)
+			attempts.attempt(deal.PieceCid, ds.Dataset, "mismatched CommP errors in boost")
 			continue
 		}
 
 		filename := ds.GenerateCarFileName(deal.PieceCid)
 		if filename == "" {
 			log.Errorf("could not find carfile name for dataset %s for CID %s", ds.Dataset, deal.PieceCid)
+			attempts.attempt(deal.PieceCid, ds.Dataset, "could not find carfile name")
 			continue
 		}
 
-		if !util.FileExists(filename) {
+		if !ds.carFileExists(filename) {
 			log.Errorf("could not find carfile %s for dataset %s for CID %s", filename, ds.Dataset, deal.PieceCid)
+			attempts.attempt(deal.PieceCid, ds.Dataset, "carfile "+filename+" not found")
 			continue
 		}
 
 		id, err := uuid.Parse(deal.ID)
 		if err != nil {
 			log.Errorf("could not parse uuid " + deal.ID)
+			attempts.attempt(deal.PieceCid, ds.Dataset, "could not parse deal uuid "+deal.ID)
 			continue
 		}
 
-		importResult := boost.ImportCar(context.Background(), filename, deal.PieceCid, id)
-		return &importResult
+		attempts.attempt(deal.PieceCid, ds.Dataset, "")
+		q.add(importJob{dataset: ds.Dataset, carFile: filename, pieceCid: deal.PieceCid, pieceSize: deal.PieceSize.Uint64(), dealUuid: id, attemptCid: deal.PieceCid})
+		queued++
 	}
 
-	log.Infof("attempted all deals for for dataset %s, none could be imported", ds.Dataset)
-	return nil
+	if queued == 0 && !q.full() {
+		log.Infof("attempted all deals for for dataset %s, none could be imported", ds.Dataset)
+	}
+	return queued
 }
 
-func importerPullDataset(cfg Config, ds Dataset, boost *svc.BoostConnection) *svc.ImportResult {
+// Requests deals for the dataset from DDM and queues them for import, returning the number of deals queued
+func importerPullDataset(ctx context.Context, cfg Config, ds Dataset, boost svc.BoostClient, q *importQueue, attempts attemptTracker) int {
 	ddm := svc.NewDDMApi(cfg.DDMURL, cfg.DDMToken)
+	queued := 0
 
-	log.Infof("requesting deal for dataset %s", ds.Dataset)
-	pieceCid, err := ddm.RequestDealForDataset(ds.Dataset, cfg.DDMDelayStart, cfg.DDMAdvanceEnd)
-	if err != nil {
-		log.Errorf("error requesting deal for dataset %s: %s", ds.Dataset, err.Error())
-		return nil
-	}
-	if pieceCid == "" {
-		log.Errorf("no deal returned for dataset %s", ds.Dataset)
-		return nil
-	}
+	for !q.full() {
+		log.Infof("requesting deal for dataset %s", ds.Dataset)
+		pieceCid, err := ddm.RequestDealForDataset(ds.Dataset, cfg.DDMDelayStart, cfg.DDMAdvanceEnd)
+		if err != nil {
+			log.Errorf("error requesting deal for dataset %s: %s", ds.Dataset, err.Error())
+			return queued
+		}
+		if pieceCid == "" {
+			log.Errorf("no deal returned for dataset %s", ds.Dataset)
+			return queued
+		}
 
-	// Successfully requested a deal - wait for it to show up in Boost
-	readyToImport, err := boost.WaitForDeal(pieceCid)
-	if err != nil {
-		log.Errorf("error waiting for deal for dataset %s: %s", ds.Dataset, err.Error())
-		return nil
-	}
+		// Successfully requested a deal - wait for it to show up in Boost
+		readyToImport, err := boost.WaitForDeal(ctx, pieceCid)
+		if err != nil {
+			log.Errorf("error waiting for deal for dataset %s: %s", ds.Dataset, err.Error())
+			return queued
+		}
 
-	// * Note: We don't need to check HasMismatchedCommPErrors here, as this should result in a newly requested deal. DDM should not allow multiple re-deals if it had been previously dealt
+		// * Note: We don't need to check HasMismatchedCommPErrors here, as this should result in a newly requested deal. DDM should not allow multiple re-deals if it had been previously dealt
 
-	// Deal has been made with boost - import it
-	// There may be several deals matching the pieceCid, but we only want to import one - take the first one
-	deal := readyToImport[0]
-	filename := ds.GenerateCarFileName(pieceCid)
+		// Deal has been made with boost - import it
+		// There may be several deals matching the pieceCid, but we only want to import one - take the first one
+		deal := readyToImport[0]
+		filename := ds.GenerateCarFileName(pieceCid)
 
-	if !util.FileExists(filename) {
-		log.Debugf("could not find carfile %s for dataset %s for CID %s", filename, ds.Dataset, pieceCid)
-		return nil
-	}
+		if !ds.carFileExists(filename) {
+			log.Debugf("could not find carfile %s for dataset %s for CID %s", filename, ds.Dataset, pieceCid)
+			return queued
+		}
 
-	id, err := uuid.Parse(deal.ID)
-	if err != nil {
-		log.Errorf("could not parse uuid " + deal.ID)
-		return nil
+		id, err := uuid.Parse(deal.ID)
+		if err != nil {
+			log.Errorf("could not parse uuid " + deal.ID)
+			return queued
+		}
+
+		attempts.attempt(pieceCid, ds.Dataset, "")
+		q.add(importJob{dataset: ds.Dataset, carFile: filename, pieceCid: pieceCid, pieceSize: deal.PieceSize.Uint64(), dealUuid: id, attemptCid: pieceCid})
+		queued++
 	}
 
-	importResult := boost.ImportCar(context.Background(), filename, pieceCid, id)
-	return &importResult
+	return queued
 }
 
-func importerPullCid(cfg Config, ds Dataset, boost *svc.BoostConnection) *svc.ImportResult {
+// Requests deals from DDM for carfiles in the dataset and queues them for import, returning the number of deals queued
+func importerPullCid(ctx context.Context, cfg Config, ds Dataset, boost svc.BoostClient, q *importQueue, attempts attemptTracker) int {
 	ddm := svc.NewDDMApi(cfg.DDMURL, cfg.DDMToken)
-	carFilePaths := ds.CarFilePaths()
+	carFiles := ds.carFiles()
 
-	ds.PopulateAlreadyImportedCids(boost)
+	if err := ds.PopulateAlreadyImportedCids(boost, cfg.addressBook); err != nil {
+		log.Errorf("skipping dataset %s : could not find carfiles already imported: %s", ds.Dataset, err)
+		return 0
+	}
 
-	if len(carFilePaths) == 0 {
+	if len(carFiles) == 0 {
 		log.Debugf("skipping dataset %s : no car files found", ds.Dataset)
-		return nil
+		return 0
 	}
 
-	log.Debugf("%d car files found for dataset %s", len(carFilePaths), ds.Dataset)
+	log.Debugf("%d car files found for dataset %s", len(carFiles), ds.Dataset)
+
+	queued := 0
+	for _, cf := range carFiles {
+		if q.full() {
+			return queued
+		}
 
-	for _, carFilePath := range carFilePaths {
-		// Assume files are named as <cidFromFilename>.car
-		cidFromFilename := util.FileNameFromPath(carFilePath)
+		// From the manifest, or assuming files are named as <fileCid>.car
+		fileCid, carFilePath := cf.pieceCid, cf.path
 
-		if ds.IsCidAlreadyImported(cidFromFilename) {
-			log.Debugf("skipping import of %s as it's already been imported previously", cidFromFilename)
+		if ds.IsCidAlreadyImported(fileCid) {
+			log.Debugf("skipping import of %s as it's already been imported previously", fileCid)
 			continue
 		}
 
-		// Don't attempt any given carfile import more than once
-		if cidsAlreadyAttempted[cidFromFilename] {
+		// Don't retry any given carfile until the backoff from the last attempt has passed
+		if !attempts.eligible(fileCid) {
 			continue
 		}
-		cidsAlreadyAttempted[cidFromFilename] = true
 
 		// See if we have failed this CID before with mismatched commP
-		otherDeals := boost.GetDealsForContent(cidFromFilename)
+		otherDeals, err := boost.GetDealsForContent(fileCid)
+		if err != nil {
+			log.Errorf("could not check deals for %s, not importing any more carfiles for dataset %s: %s", fileCid, ds.Dataset, err)
+			return queued
+		}
 		if otherDeals.HasMismatchedCommPErrors() {
-			log.Debugf("skipping import of %s as there are mismatched CommP errors for it", cidFromFilename)
+			log.Debugf("skipping import of %s as there are mismatched CommP errors for it", fileCid)
+			attempts.attempt(fileCid, ds.Dataset, "mismatched CommP errors in boost")
 			continue
 		}
 
-		log.Infof("requesting deal for dataset %s, cid %s", ds.Dataset, cidFromFilename)
-		pieceCid, err := ddm.RequestDealForCid(cidFromFilename, cfg.DDMDelayStart, cfg.DDMAdvanceEnd)
+		attempts.attempt(fileCid, ds.Dataset, "")
+
+		log.Infof("requesting deal for dataset %s, cid %s", ds.Dataset, fileCid)
+		pieceCid, err := ddm.RequestDealForCid(fileCid, cfg.DDMDelayStart, cfg.DDMAdvanceEnd)
 		if err != nil {
-			log.Errorf("error requesting deal for cid %s: %s", cidFromFilename, err.Error())
-			return nil
+			log.Errorf("error requesting deal for cid %s: %s", fileCid, err.Error())
+			attempts.failed(fileCid, "error requesting deal: "+err.Error())
+			return queued
 		}
 		if pieceCid == "" {
 			log.Errorf("no deal returned for dataset %s", ds.Dataset)
-			return nil
+			attempts.failed(fileCid, "no deal returned")
+			return queued
 		}
 
 		// Successfully requested a deal - wait for it to show up in Boost
-		readyToImport, err := boost.WaitForDeal(pieceCid)
+		readyToImport, err := boost.WaitForDeal(ctx, pieceCid)
 		if err != nil {
 			log.Errorf("error waiting for deal for dataset %s: %s", ds.Dataset, err.Error())
-			return nil
+			attempts.failed(fileCid, "error waiting for deal: "+err.Error())
+			return queued
 		}
 
 		// Deal has been made with boost - import it
@@ -219,21 +338,25 @@ func importerPullCid(cfg Config, ds Dataset, boost *svc.BoostConnection) *svc.Im
 		deal := readyToImport[0]
 
 		// This should not happen as we just read the file, but check anyway in case the file has been deleted very recently
-		if !util.FileExists(carFilePath) {
+		if !ds.carFileExists(carFilePath) {
 			log.Errorf("could not find carfile %s for dataset %s for CID %s. it must have been deleted", carFilePath, ds.Dataset, pieceCid)
-			return nil
+			attempts.failed(fileCid, "carfile "+carFilePath+" not found")
+			return queued
 		}
 
 		id, err := uuid.Parse(deal.ID)
 		if err != nil {
 			log.Errorf("could not parse uuid " + deal.ID)
-			return nil
+			attempts.failed(fileCid, "could not parse deal uuid "+deal.ID)
+			return queued
 		}
 
-		importResult := boost.ImportCar(context.Background(), carFilePath, pieceCid, id)
-		return &importResult
+		q.add(importJob{dataset: ds.Dataset, carFile: carFilePath, pieceCid: pieceCid, pieceSize: deal.PieceSize.Uint64(), dealUuid: id, attemptCid: fileCid})
+		queued++
 	}
 
-	log.Infof("attempted to import all carfiles for dataset %d, but none could be imported", ds.Dataset)
-	return nil
+	if queued == 0 {
+		log.Infof("attempted to import all carfiles for dataset %s, but none could be imported", ds.Dataset)
+	}
+	return queued
 }
@@ -0,0 +1,218 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/application-research/delta-importer/db"
+	svc "github.com/application-research/delta-importer/services"
+	"github.com/application-research/delta-importer/services/fakeboost"
+	"github.com/application-research/delta-importer/services/fakeddm"
+	"github.com/google/uuid"
+)
+
+// Runs a default mode import cycle against a fake Boost, and checks only the deals the importer should pick are imported
+func TestImporterDefault(t *testing.T) {
+	fb, err := fakeboost.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Close()
+
+	dir := t.TempDir()
+	ds := Dataset{Dataset: "test", Addresses: []string{"f1aaa"}, Dir: dir}
+
+	addDeal := func(pieceCid string, clientAddress string, start time.Time, withCarFile bool) string {
+		id := uuid.New().String()
+		if withCarFile {
+			if err := os.WriteFile(filepath.Join(dir, pieceCid+".car"), []byte("car"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fb.AddDeal(svc.Deal{
+			ID:            id,
+			PieceCid:      pieceCid,
+			IsOffline:     true,
+			ClientAddress: clientAddress,
+			PieceSize:     fakeboost.PieceSize(1 << 20),
+			Checkpoint:    "Accepted",
+			StartEpoch:    fakeboost.StartEpochAt(start),
+		})
+		return id
+	}
+
+	later := time.Now().Add(72 * time.Hour)
+	imported := addDeal("baga-imported", "f1aaa", later, true)
+	addDeal("baga-no-carfile", "f1aaa", later, false)
+	addDeal("baga-other-client", "f1aaab", later, true)
+	addDeal("baga-too-late", "f1aaa", time.Now().Add(time.Hour), true)
+
+	cfg := Config{
+		BoostAddress:      fb.Address(),
+		BoostPort:         fb.Port(),
+		BoostGqlPort:      fb.Port(),
+		BoostAPIKey:       "test",
+		Mode:              ModeDefault,
+		DealOrder:         DealOrderUrgency,
+		SealingMargin:     30,
+		MaxConcurrent:     10,
+		ImportParallelism: 2,
+		RetryBackoff:      600,
+		Interval:          60,
+		Pacing:            PacingFixed,
+		DataDir:           t.TempDir(),
+	}
+
+	didb, err := db.OpenDIDB(cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer didb.Close()
+
+	importer(context.Background(), nil, cfg, didb, NewScheduler(cfg.Schedule), newPacer(cfg, didb), nil, []Dataset{ds})
+
+	imports := fb.Imports()
+	if len(imports) != 1 {
+		t.Fatalf("expected 1 import, got %d: %+v", len(imports), imports)
+	}
+	if got, want := imports[imported].FilePath, filepath.Join(dir, "baga-imported.car"); got != want {
+		t.Errorf("imported %s, expected %s", got, want)
+	}
+
+	deals, err := didb.GetDeals(db.PENDING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*deals) != 1 || (*deals)[0].DealUuid != imported || (*deals)[0].Dataset != "test" {
+		t.Errorf("expected the import of %s to be recorded, got %+v", imported, *deals)
+	}
+	// Recorded by piece size, not the size of the carfile, so it counts towards quotas in the same unit as the pipeline
+	if len(*deals) == 1 && (*deals)[0].Size != 1<<20 {
+		t.Errorf("expected the import to be recorded with its piece size, got %d", (*deals)[0].Size)
+	}
+
+	// Whether a deal can make its start epoch depends on the pipeline, so it is skipped without using up an attempt
+	if a, err := didb.GetImportAttempt("baga-too-late"); err != nil || a != nil {
+		t.Errorf("expected no attempt to be recorded for the deal that can't make its start epoch, got %+v %v", a, err)
+	}
+
+	a, err := didb.GetImportAttempt("baga-no-carfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == nil || a.LastError == "" {
+		t.Errorf("expected a failed attempt to be recorded for the deal without a carfile, got %+v", a)
+	}
+}
+
+// Runs a pull-cid import cycle against a fake Boost and DDM, and checks deals are requested and imported only for carfiles not already sealed
+func TestImporterPullCid(t *testing.T) {
+	fb, err := fakeboost.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Close()
+
+	dir := t.TempDir()
+	for _, pieceCid := range []string{"baga-new", "baga-sealed"} {
+		if err := os.WriteFile(filepath.Join(dir, pieceCid+".car"), []byte("car"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fb.AddDeal(svc.Deal{
+		ID:            uuid.New().String(),
+		PieceCid:      "baga-sealed",
+		ClientAddress: "f1aaa",
+		PieceSize:     fakeboost.PieceSize(1 << 20),
+		Checkpoint:    "IndexedAndAnnounced",
+		Message:       "Sealer: Proving",
+	})
+
+	// DDM makes a deal in Boost for each cid requested
+	var mu sync.Mutex
+	var requested []fakeddm.Request
+	ddm, err := fakeddm.New("test", func(req fakeddm.Request) (string, error) {
+		mu.Lock()
+		requested = append(requested, req)
+		mu.Unlock()
+
+		fb.AddDeal(svc.Deal{
+			ID:            uuid.New().String(),
+			PieceCid:      req.Cid,
+			IsOffline:     true,
+			ClientAddress: "f1aaa",
+			PieceSize:     fakeboost.PieceSize(1 << 20),
+			Checkpoint:    "Accepted",
+			StartEpoch:    fakeboost.StartEpochAt(time.Now().Add(time.Duration(req.StartEpochDelay) * 24 * time.Hour)),
+		})
+		return req.Cid, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ddm.Close()
+
+	prevRetry := svc.WaitForDealRetryInterval
+	svc.WaitForDealRetryInterval = 10 * time.Millisecond
+	defer func() { svc.WaitForDealRetryInterval = prevRetry }()
+
+	datasetsFile := filepath.Join(t.TempDir(), "datasets.json")
+	if err := os.WriteFile(datasetsFile, []byte(`[{"dataset": "test", "address": ["f1aaa"], "dir": "`+dir+`"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	datasets, err := LoadDatasetsFromFile(datasetsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		BoostAddress:      fb.Address(),
+		BoostPort:         fb.Port(),
+		BoostGqlPort:      fb.Port(),
+		BoostAPIKey:       "test",
+		Mode:              ModePullCID,
+		DDMURL:            ddm.URL(),
+		DDMToken:          "test",
+		DDMDelayStart:     3,
+		MaxConcurrent:     10,
+		ImportParallelism: 1,
+		RetryBackoff:      600,
+		Interval:          60,
+		Pacing:            PacingFixed,
+		DataDir:           t.TempDir(),
+	}
+
+	didb, err := db.OpenDIDB(cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer didb.Close()
+
+	importer(context.Background(), nil, cfg, didb, NewScheduler(cfg.Schedule), newPacer(cfg, didb), nil, datasets)
+
+	if len(requested) != 1 || requested[0].Cid != "baga-new" || requested[0].StartEpochDelay != 3 {
+		t.Fatalf("expected one deal to be requested for baga-new with a 3 day delay, got %+v", requested)
+	}
+
+	imports := fb.Imports()
+	if len(imports) != 1 {
+		t.Fatalf("expected 1 import, got %d: %+v", len(imports), imports)
+	}
+	for _, imp := range imports {
+		if got, want := imp.FilePath, filepath.Join(dir, "baga-new.car"); got != want {
+			t.Errorf("imported %s, expected %s", got, want)
+		}
+	}
+
+	deals, err := didb.GetDeals(db.PENDING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*deals) != 1 || (*deals)[0].CommP != "baga-new" || (*deals)[0].Mode != string(ModePullCID) {
+		t.Errorf("expected the import of baga-new to be recorded, got %+v", *deals)
+	}
+}
@@ -0,0 +1,229 @@
+package daemon
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A carfile listed in a dataset manifest
+type ManifestEntry struct {
+	PieceCid   string `json:"piece_cid"`
+	PayloadCid string `json:"payload_cid"`
+	PieceSize  uint64 `json:"piece_size"`
+	FilePath   string `json:"file_path"` // Relative paths are relative to the manifest's directory
+}
+
+// manifestIndex maps piece cids to carfiles using a manifest written by a data-prep tool
+// The manifest is re-read whenever it changes on disk
+type manifestIndex struct {
+	fileName string
+	mu       sync.Mutex
+	modTime  time.Time
+	size     int64
+	entries  []ManifestEntry
+	byPiece  map[string]ManifestEntry
+}
+
+// Load a manifest (.csv or .json) into an index
+func newManifestIndex(fileName string) (*manifestIndex, error) {
+	m := &manifestIndex{fileName: fileName}
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Re-read the manifest if it has changed since it was last read. If it is now invalid, the previous entries are kept
+func (m *manifestIndex) refresh() {
+	fi, err := os.Stat(m.fileName)
+	if err != nil {
+		log.Errorf("could not check manifest %s: %s", m.fileName, err)
+		return
+	}
+
+	m.mu.Lock()
+	changed := !fi.ModTime().Equal(m.modTime) || fi.Size() != m.size
+	m.mu.Unlock()
+
+	if changed {
+		if err := m.reload(); err != nil {
+			log.Errorf("could not reload manifest, keeping previous entries: %s", err)
+			// Don't try again until the manifest changes
+			m.mu.Lock()
+			m.modTime, m.size = fi.ModTime(), fi.Size()
+			m.mu.Unlock()
+			return
+		}
+		log.Infof("reloaded manifest %s", m.fileName)
+	}
+}
+
+func (m *manifestIndex) reload() error {
+	f, err := os.Open(m.fileName)
+	if err != nil {
+		return fmt.Errorf("error opening manifest %s: %w", m.fileName, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("error opening manifest %s: %w", m.fileName, err)
+	}
+
+	var entries []ManifestEntry
+	switch strings.ToLower(filepath.Ext(m.fileName)) {
+	case ".csv":
+		entries, err = readCsvManifest(f)
+	case ".json":
+		err = json.NewDecoder(f).Decode(&entries)
+	default:
+		err = fmt.Errorf("unsupported manifest format %q - must be .csv or .json", filepath.Ext(m.fileName))
+	}
+	if err != nil {
+		return fmt.Errorf("error reading manifest %s: %w", m.fileName, err)
+	}
+
+	byPiece := make(map[string]ManifestEntry, len(entries))
+	for i, e := range entries {
+		if e.PieceCid == "" || e.FilePath == "" {
+			return fmt.Errorf("error reading manifest %s: entry %d is missing piece_cid or file_path", m.fileName, i+1)
+		}
+		if !filepath.IsAbs(e.FilePath) {
+			e.FilePath = filepath.Join(filepath.Dir(m.fileName), e.FilePath)
+		}
+		entries[i] = e
+		byPiece[e.PieceCid] = e
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.modTime = fi.ModTime()
+	m.size = fi.Size()
+	m.entries = entries
+	m.byPiece = byPiece
+
+	return nil
+}
+
+// Reads a CSV manifest with a header row. piece_cid and file_path columns are required, payload_cid and piece_size are optional
+func readCsvManifest(r io.Reader) ([]ManifestEntry, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read header: %w", err)
+	}
+
+	cols := make(map[string]int)
+	for i, name := range header {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"piece_cid", "file_path"} {
+		if _, ok := cols[required]; !ok {
+			return nil, fmt.Errorf("missing %s column", required)
+		}
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := cols[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var entries []ManifestEntry
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		e := ManifestEntry{
+			PieceCid:   field(record, "piece_cid"),
+			PayloadCid: field(record, "payload_cid"),
+			FilePath:   field(record, "file_path"),
+		}
+		if size := field(record, "piece_size"); size != "" {
+			e.PieceSize, err = strconv.ParseUint(size, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid piece_size %q for %s", size, e.PieceCid)
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// Find the manifest entry for a piece cid
+func (m *manifestIndex) lookup(pieceCid string) (ManifestEntry, bool) {
+	m.refresh()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.byPiece[pieceCid]
+	return e, ok
+}
+
+// All entries in the manifest, in the order they appear
+func (m *manifestIndex) all() []ManifestEntry {
+	m.refresh()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.entries
+}
+
+// manifestChecker compares the piece size in a dataset's manifest to the deal's, so a carfile prepared for a different piece isn't imported
+type manifestChecker struct {
+	manifests map[string]*manifestIndex
+}
+
+func newManifestChecker(datasets []Dataset) manifestChecker {
+	c := manifestChecker{manifests: make(map[string]*manifestIndex)}
+	for _, ds := range datasets {
+		if ds.manifest != nil {
+			c.manifests[ds.Dataset] = ds.manifest
+		}
+	}
+	return c
+}
+
+// True if any dataset has a manifest
+func (c manifestChecker) enabled() bool {
+	return len(c.manifests) > 0
+}
+
+// Pre-import check that fails if the manifest gives a piece size for the carfile that doesn't match the deal
+func (c manifestChecker) check(ctx context.Context, job *importJob) error {
+	m, ok := c.manifests[job.dataset]
+	if !ok {
+		return nil
+	}
+
+	e, ok := m.lookup(job.pieceCid)
+	if !ok || e.PieceSize == 0 || job.pieceSize == 0 {
+		return nil
+	}
+	if e.PieceSize != job.pieceSize {
+		return fmt.Errorf("piece size mismatch: deal has %d, manifest has %d for %s", job.pieceSize, e.PieceSize, job.pieceCid)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeManifest(t *testing.T, name string, content string) string {
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestManifestCheckerComparesPieceSize(t *testing.T) {
+	m, err := newManifestIndex(writeManifest(t, "manifest.csv", "piece_cid,piece_size,file_path\nbaga-sized,2048,a.car\nbaga-unsized,,b.car\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := newManifestChecker([]Dataset{{Dataset: "test", manifest: m}, {Dataset: "no-manifest"}})
+
+	cases := []struct {
+		name      string
+		dataset   string
+		pieceCid  string
+		pieceSize uint64
+		fails     bool
+	}{
+		{"matching size", "test", "baga-sized", 2048, false},
+		{"mismatched size", "test", "baga-sized", 4096, true},
+		{"no size in manifest", "test", "baga-unsized", 4096, false},
+		{"not in manifest", "test", "baga-missing", 4096, false},
+		{"deal size unknown", "test", "baga-sized", 0, false},
+		{"dataset without manifest", "no-manifest", "baga-sized", 4096, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := checker.check(context.Background(), &importJob{dataset: c.dataset, pieceCid: c.pieceCid, pieceSize: c.pieceSize})
+			if (err != nil) != c.fails {
+				t.Errorf("expected failure to be %t, got %v", c.fails, err)
+			}
+		})
+	}
+}
+
+func TestManifestParse(t *testing.T) {
+	cases := []struct {
+		name     string
+		file     string
+		content  string
+		expected []ManifestEntry // Nil if the manifest is invalid
+	}{
+		{
+			"csv", "manifest.csv",
+			"piece_cid,payload_cid,piece_size,file_path\nbaga-a,bafy-a,2048,a.car\nbaga-b,,,/data/b.car\n",
+			[]ManifestEntry{{PieceCid: "baga-a", PayloadCid: "bafy-a", PieceSize: 2048, FilePath: "a.car"}, {PieceCid: "baga-b", FilePath: "/data/b.car"}},
+		},
+		{
+			"csv columns in any order, case and spacing", "manifest.csv",
+			"File_Path, Piece_CID\nsub/a.car, baga-a\n",
+			[]ManifestEntry{{PieceCid: "baga-a", FilePath: "sub/a.car"}},
+		},
+		{
+			"csv short row", "manifest.csv",
+			"piece_cid,file_path,piece_size\nbaga-a,a.car\n",
+			[]ManifestEntry{{PieceCid: "baga-a", FilePath: "a.car"}},
+		},
+		{
+			"json", "manifest.json",
+			`[{"piece_cid": "baga-a", "payload_cid": "bafy-a", "piece_size": 2048, "file_path": "a.car"}]`,
+			[]ManifestEntry{{PieceCid: "baga-a", PayloadCid: "bafy-a", PieceSize: 2048, FilePath: "a.car"}},
+		},
+		{"csv missing file_path column", "manifest.csv", "piece_cid,piece_size\nbaga-a,2048\n", nil},
+		{"csv invalid piece size", "manifest.csv", "piece_cid,piece_size,file_path\nbaga-a,big,a.car\n", nil},
+		{"csv entry missing file path", "manifest.csv", "piece_cid,file_path\nbaga-a,\n", nil},
+		{"invalid json", "manifest.json", `[{"piece_cid": "baga-a"`, nil},
+		{"unsupported format", "manifest.txt", "baga-a a.car\n", nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fileName := writeManifest(t, c.file, c.content)
+			m, err := newManifestIndex(fileName)
+			if c.expected == nil {
+				if err == nil {
+					t.Fatalf("expected the manifest to be invalid, got %+v", m.all())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entries := m.all()
+			if len(entries) != len(c.expected) {
+				t.Fatalf("expected %d entries, got %+v", len(c.expected), entries)
+			}
+			for i, want := range c.expected {
+				// Relative paths are relative to the manifest
+				if !filepath.IsAbs(want.FilePath) {
+					want.FilePath = filepath.Join(filepath.Dir(fileName), want.FilePath)
+				}
+				if entries[i] != want {
+					t.Errorf("expected entry %d to be %+v, got %+v", i, want, entries[i])
+				}
+			}
+		})
+	}
+}
+
+// The manifest is re-read when it changes, and kept as it was if the new version is invalid
+func TestManifestReload(t *testing.T) {
+	fileName := writeManifest(t, "manifest.csv", "piece_cid,file_path\nbaga-a,a.car\n")
+	m, err := newManifestIndex(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(fileName, []byte("piece_cid,file_path\nbaga-a,a.car\nbaga-b,b.car\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.lookup("baga-b"); !ok {
+		t.Errorf("expected an entry added to the manifest to be found")
+	}
+
+	if err := os.WriteFile(fileName, []byte("piece_cid,payload_cid\nbaga-c,bafy-c\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.lookup("baga-b"); !ok {
+		t.Errorf("expected the previous entries to be kept when the manifest is invalid")
+	}
+	if entries := m.all(); len(entries) != 2 {
+		t.Errorf("expected the 2 previous entries, got %+v", entries)
+	}
+}
@@ -0,0 +1,166 @@
+package daemon
+
+import (
+	"sync"
+	"time"
+
+	"github.com/application-research/delta-importer/daemon/api"
+	"github.com/application-research/delta-importer/db"
+	log "github.com/sirupsen/logrus"
+)
+
+type Pacing string
+
+const (
+	// Run the importer every --interval seconds
+	PacingFixed Pacing = "fixed"
+	// Run the importer between --min-interval and --interval seconds apart, to hold the pipeline at the target depth
+	PacingAdaptive Pacing = "adaptive"
+)
+
+// How quickly the pacer tries to close the gap between the current and target pipeline depth
+const PACING_HORIZON = time.Duration(1 * time.Hour)
+
+// Weight given to the newest throughput sample (exponential moving average)
+const PACING_SMOOTHING = 0.3
+
+// pacer measures how fast deals leave the sealing pipeline, and picks the time until the next import cycle
+type pacer struct {
+	cfg        Config
+	mu         sync.Mutex
+	sampled    bool
+	lastSample time.Time
+	lastDepth  int
+	imported   int
+	throughput float64 // Deals leaving the pipeline per hour
+	interval   time.Duration
+}
+
+// Create a pacer, seeding the throughput from the deals the reconciler saw leave the pipeline in the last day
+func newPacer(cfg Config, didb *db.DIDB) *pacer {
+	p := &pacer{
+		cfg:      cfg,
+		interval: time.Second * time.Duration(cfg.Interval),
+	}
+
+	settled, err := didb.CountDealsSettledSince(now().Add(-24 * time.Hour))
+	if err != nil {
+		log.Errorf("could not get recently settled deals: %s", err)
+	} else {
+		p.throughput = float64(settled) / 24
+	}
+
+	return p
+}
+
+// The pipeline depth the importer should fill up to. 0 = unlimited
+func (p *pacer) maxDepth() uint {
+	if p.cfg.Pacing != PacingAdaptive || p.cfg.TargetDepth == 0 {
+		return p.cfg.MaxConcurrent
+	}
+	if p.cfg.MaxConcurrent != 0 && p.cfg.MaxConcurrent < p.cfg.TargetDepth {
+		return p.cfg.MaxConcurrent
+	}
+	return p.cfg.TargetDepth
+}
+
+// Record the pipeline depth at the start of an import cycle, and the number of deals successfully imported in it
+// Deals that left the pipeline since the last cycle are the previous depth plus those imported, less the current depth
+func (p *pacer) observe(depth int, imported int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t := now()
+	if p.sampled {
+		if elapsed := t.Sub(p.lastSample).Hours(); elapsed > 0 {
+			departed := p.lastDepth + p.imported - depth
+			if departed < 0 {
+				departed = 0
+			}
+			p.throughput = PACING_SMOOTHING*(float64(departed)/elapsed) + (1-PACING_SMOOTHING)*p.throughput
+		}
+	}
+
+	p.sampled = true
+	p.lastSample = t
+	p.lastDepth = depth
+	p.imported = imported
+	p.interval = p.nextInterval()
+
+	log.Debugf("pipeline depth %d, throughput %.1f deals/hour, next import in %s", depth, p.throughput, p.interval)
+}
+
+// Adaptive pacing imports at the rate deals leave the pipeline, plus enough to reach the target depth within PACING_HORIZON
+// Each cycle imports up to max-per-cycle deals (or 1), so the interval is the time to import that many at this rate
+func (p *pacer) nextInterval() time.Duration {
+	maxInterval := time.Second * time.Duration(p.cfg.Interval)
+	if p.cfg.Pacing != PacingAdaptive {
+		return maxInterval
+	}
+	minInterval := time.Second * time.Duration(p.cfg.MinInterval)
+
+	rate := p.importRate()
+	if rate <= 0 {
+		return maxInterval
+	}
+
+	interval := time.Duration(float64(p.perCycle()) / rate * float64(time.Hour))
+	if interval < minInterval {
+		return minInterval
+	}
+	if interval > maxInterval {
+		return maxInterval
+	}
+	return interval
+}
+
+// Most deals to import in a cycle (0 = no limit beyond maxDepth)
+// Adaptive pacing spreads imports out over cycles, so imports max-per-cycle deals (or 1) per cycle rather than filling up to the target at once
+func (p *pacer) perCycle() uint {
+	if p.cfg.Pacing == PacingAdaptive && p.cfg.MaxPerCycle == 0 {
+		return 1
+	}
+	return p.cfg.MaxPerCycle
+}
+
+// Deals per hour to import to hold the pipeline at the target depth
+func (p *pacer) importRate() float64 {
+	if p.cfg.Pacing != PacingAdaptive {
+		return 0
+	}
+	return p.throughput + float64(int(p.maxDepth())-p.lastDepth)/PACING_HORIZON.Hours()
+}
+
+// Pipeline depth at the last import cycle, and the deals per hour leaving it
+func (p *pacer) pipeline() (int, float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastDepth, p.throughput
+}
+
+// Time to wait until the next import cycle
+func (p *pacer) wait() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.interval
+}
+
+func (p *pacer) Stats() api.PacingStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := api.PacingStats{
+		Pacing:        string(p.cfg.Pacing),
+		PipelineDepth: p.lastDepth,
+		Throughput:    p.throughput,
+		Interval:      uint(p.interval.Seconds()),
+	}
+	if p.cfg.Pacing == PacingAdaptive {
+		stats.TargetDepth = p.maxDepth()
+		if rate := p.importRate(); rate > 0 {
+			stats.ImportRate = rate
+		}
+	}
+
+	return stats
+}
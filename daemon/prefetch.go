@@ -0,0 +1,255 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/application-research/delta-importer/db"
+	svc "github.com/application-research/delta-importer/services"
+	util "github.com/application-research/delta-importer/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often the prefetcher looks for upcoming carfiles to stage
+const PREFETCH_INTERVAL = time.Duration(1 * time.Minute)
+
+// A carfile the importer is expected to pick up soon
+type prefetchCandidate struct {
+	dataset  string
+	carFile  string
+	pieceCid string
+	size     uint64
+}
+
+// prefetcher copies the carfiles the importer is expected to pick next into staging ahead of time,
+// so the import doesn't have to wait for the copy. ImportCar uses the prefetched file if it is there
+type prefetcher struct {
+	cfg      Config
+	db       *db.DIDB
+	policy   SchedulePolicy
+	pace     *pacer
+	staging  *svc.Staging
+	datasets *DatasetStore
+	budget   uint64 // Most bytes of prefetched carfiles to keep in staging (0 = no limit)
+}
+
+func newPrefetcher(cfg Config, db *db.DIDB, sched *Scheduler, pace *pacer, staging *svc.Staging, datasets *DatasetStore) *prefetcher {
+	return &prefetcher{
+		cfg:      cfg,
+		db:       db,
+		policy:   sched.policy,
+		pace:     pace,
+		staging:  staging,
+		datasets: datasets,
+		budget:   uint64(cfg.PrefetchBudget) << 30,
+	}
+}
+
+// Run prefetches periodically until ctx is cancelled. A copy cut off by shutdown is kept, and resumed when the carfile is next staged
+func (p *prefetcher) Run(ctx context.Context) {
+	if restored := p.staging.RestorePrefetched(); restored > 0 {
+		log.Infof("found %d car files prefetched before the daemon restarted", restored)
+	}
+
+	for {
+		p.prefetch(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(PREFETCH_INTERVAL):
+		}
+	}
+}
+
+// Stage the next carfiles the importer is expected to pick, evicting prefetched carfiles that are no longer expected
+func (p *prefetcher) prefetch(ctx context.Context) {
+	boost, err := newBoostClient(p.cfg, nil)
+	if err != nil {
+		log.Errorf("error creating boost connection for prefetch: %s", err.Error())
+		return
+	}
+	defer boost.Close()
+
+	// Without the full prediction, prefetched carfiles that are still expected would be evicted - try again next time
+	upcoming, err := p.upcoming(boost)
+	if err != nil {
+		log.Errorf("skipping prefetch: %s", err)
+		return
+	}
+
+	// Free up the space taken by carfiles that have dropped out of the prediction (ex. the deal was cancelled)
+	expected := make(map[string]bool)
+	for _, c := range upcoming {
+		expected[c.pieceCid+".car"] = true
+	}
+	names, prefetchedBytes := p.staging.Prefetched()
+	for _, name := range names {
+		if !expected[name] {
+			log.Debugf("evicting prefetched car file %s, it is no longer expected to be imported soon", name)
+			p.staging.Evict(name)
+		}
+	}
+
+	for _, c := range upcoming {
+		if ctx.Err() != nil {
+			return
+		}
+
+		name := c.pieceCid + ".car"
+		names, prefetchedBytes = p.staging.Prefetched()
+		if contains(names, name) {
+			continue
+		}
+		if p.budget != 0 && prefetchedBytes+c.size > p.budget {
+			log.Debugf("prefetch budget of %s reached, not prefetching %s", util.BytesToReadable(int64(p.budget)), c.carFile)
+			return
+		}
+
+		log.Infof("prefetching %s for dataset %s", c.carFile, c.dataset)
+		if err := p.staging.Prefetch(ctx, c.carFile, name); err != nil {
+			if errors.Is(err, svc.ErrNoStagingSpace) {
+				log.Debugf("not prefetching any more car files: %s", err)
+				return
+			}
+			log.Errorf("failed to prefetch %s: %s", c.carFile, err)
+		}
+	}
+}
+
+// Predict the next carfiles the importer will pick, in the order it will pick them, up to the prefetch count
+func (p *prefetcher) upcoming(boost svc.BoostClient) ([]prefetchCandidate, error) {
+	attempts := attemptTracker{db: p.db, cfg: p.cfg}
+	limit := int(p.cfg.Prefetch)
+	depth, throughput := p.pace.pipeline()
+	sealing := estimateSealing(p.db, depth, throughput, time.Minute*time.Duration(p.cfg.SealingMargin))
+
+	var perDataset [][]prefetchCandidate
+	for _, ds := range byPriority(p.datasets.Datasets()) {
+		// Remote carfiles are downloaded by the importer
+		if ds.Source != nil {
+			continue
+		}
+
+		var candidates []prefetchCandidate
+		var err error
+		switch p.cfg.Mode {
+		case ModePullCID:
+			candidates, err = upcomingPullCid(ds, boost, p.cfg.addressBook, attempts, limit)
+		case ModePullDataset:
+			// Carfiles aren't known until DDM makes a deal for them
+		default:
+			candidates, err = upcomingDefault(ds, boost, p.cfg.addressBook, attempts, p.cfg.DealOrder, sealing, limit)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("dataset %s: %w", ds.Dataset, err)
+		}
+		perDataset = append(perDataset, candidates)
+	}
+
+	// With weighted scheduling, datasets take turns - so take a carfile from each in turn
+	var upcoming []prefetchCandidate
+	if p.policy == ScheduleWeighted {
+		for i := 0; len(upcoming) < limit; i++ {
+			added := false
+			for _, candidates := range perDataset {
+				if i < len(candidates) && len(upcoming) < limit {
+					upcoming = append(upcoming, candidates[i])
+					added = true
+				}
+			}
+			if !added {
+				break
+			}
+		}
+		return upcoming, nil
+	}
+
+	for _, candidates := range perDataset {
+		for _, c := range candidates {
+			if len(upcoming) == limit {
+				return upcoming, nil
+			}
+			upcoming = append(upcoming, c)
+		}
+	}
+	return upcoming, nil
+}
+
+// Deals awaiting import the importer would pick for the dataset, in deal order. Mirrors the checks in importerDefault, without recording attempts
+func upcomingDefault(ds Dataset, boost svc.BoostClient, book AddressBook, attempts attemptTracker, order DealOrder, sealing sealingEstimate, limit int) ([]prefetchCandidate, error) {
+	toImport, err := boost.GetDealsAwaitingImport(book.resolve(ds.Addresses))
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []prefetchCandidate
+	for _, deal := range orderDeals(toImport, order, now(), sealing.duration) {
+		if len(candidates) == limit {
+			break
+		}
+
+		if !attempts.eligible(deal.PieceCid) {
+			continue
+		}
+		if !sealing.feasible(deal, now()) {
+			continue
+		}
+
+		filename := ds.GenerateCarFileName(deal.PieceCid)
+		if filename == "" || !ds.carFileExists(filename) {
+			continue
+		}
+
+		otherDeals, err := boost.GetDealsForContent(deal.PieceCid)
+		if err != nil {
+			return nil, err
+		}
+		if otherDeals.HasMismatchedCommPErrors() {
+			continue
+		}
+
+		candidates = append(candidates, prefetchCandidate{dataset: ds.Dataset, carFile: filename, pieceCid: deal.PieceCid, size: stagedSize(filename)})
+	}
+	return candidates, nil
+}
+
+// Carfiles not yet imported that the importer would request deals for, in the order it would request them
+// The staged file is named by the carfile's cid, so it is only used if DDM makes a deal for the same piece cid
+func upcomingPullCid(ds Dataset, boost svc.BoostClient, book AddressBook, attempts attemptTracker, limit int) ([]prefetchCandidate, error) {
+	if err := ds.PopulateAlreadyImportedCids(boost, book); err != nil {
+		return nil, err
+	}
+
+	var candidates []prefetchCandidate
+	for _, cf := range ds.carFiles() {
+		if len(candidates) == limit {
+			break
+		}
+		if ds.IsCidAlreadyImported(cf.pieceCid) || !attempts.eligible(cf.pieceCid) {
+			continue
+		}
+
+		candidates = append(candidates, prefetchCandidate{dataset: ds.Dataset, carFile: cf.path, pieceCid: cf.pieceCid, size: stagedSize(cf.path)})
+	}
+	return candidates, nil
+}
+
+// Size a carfile will take up in staging - decompressed, if it is compressed and the size is known
+func stagedSize(carFile string) uint64 {
+	if size, ok := util.DecompressedSize(carFile); ok {
+		return uint64(size)
+	}
+	return uint64(util.FileSize(carFile))
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
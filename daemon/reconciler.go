@@ -1,12 +1,12 @@
 package daemon
 
 import (
+	"context"
 	"strings"
 	"time"
 
 	"github.com/application-research/delta-importer/db"
 	didb "github.com/application-research/delta-importer/db"
-	svc "github.com/application-research/delta-importer/services"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -24,10 +24,16 @@ func NewDealReconciler(cfg Config, db *db.DIDB) *DealReconciler {
 	}
 }
 
-func (dr *DealReconciler) Run() {
+// Run reconciles deals periodically until ctx is cancelled
+func (dr *DealReconciler) Run(ctx context.Context) {
 	for {
 		dr.reconcileImportedDeals()
-		time.Sleep(time.Second * time.Duration(dr.interval))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * time.Duration(dr.interval)):
+		}
 	}
 }
 
@@ -38,7 +44,7 @@ func (dr *DealReconciler) reconcileImportedDeals() {
 		log.Errorf("error getting pending deals: %s", err)
 	}
 
-	boost, err := svc.NewBoostConnection(dr.cfg.BoostAddress, dr.cfg.BoostPort, dr.cfg.BoostGqlPort, dr.cfg.BoostAPIKey, dr.cfg.StagingDir, dr.cfg.DeleteAfterImport)
+	boost, err := newBoostClient(dr.cfg, nil)
 	if err != nil {
 		log.Errorf("error creating boost connection: %s", err.Error())
 		return
@@ -54,12 +60,12 @@ func (dr *DealReconciler) reconcileImportedDeals() {
 
 		switch {
 		case deal.Message == "Sealer: Proving":
-			err = dr.db.UpdateDeal(d.DealUuid, didb.SUCCESS, "")
+			err = dr.db.UpdateDeal(d.DealUuid, didb.SUCCESS, "", now())
 			if err != nil {
 				log.Errorf("error updating deal %s status to success: %s", d.DealUuid, err)
 			}
 		case strings.HasPrefix(deal.Message, "Error"):
-			err = dr.db.UpdateDeal(d.DealUuid, didb.FAILURE, "")
+			err = dr.db.UpdateDeal(d.DealUuid, didb.FAILURE, "", now())
 			if err != nil {
 				log.Errorf("error updating deal %s status to failed: %s", d.DealUuid, err)
 			}
@@ -0,0 +1,84 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/application-research/delta-importer/db"
+	svc "github.com/application-research/delta-importer/services"
+	"github.com/application-research/delta-importer/services/fakeboost"
+	"github.com/google/uuid"
+)
+
+// Pending imports are marked as succeeded once proving, or failed on a sealing error. Anything else stays pending
+func TestReconcileImportedDeals(t *testing.T) {
+	fb, err := fakeboost.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Close()
+
+	cfg := Config{
+		BoostAddress: fb.Address(),
+		BoostPort:    fb.Port(),
+		BoostGqlPort: fb.Port(),
+		BoostAPIKey:  "test",
+		Interval:     60,
+	}
+	didb, err := db.OpenDIDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer didb.Close()
+
+	cases := []struct {
+		name     string
+		message  string
+		inBoost  bool
+		expected string
+	}{
+		{"proving", "Sealer: Proving", true, db.SUCCESS},
+		{"sealing error", "Error: sealing failed", true, db.FAILURE},
+		{"still sealing", "Sealer: PreCommit1", true, db.PENDING},
+		{"not found in boost", "", false, db.PENDING},
+	}
+
+	ids := make([]string, len(cases))
+	for i, c := range cases {
+		ids[i] = uuid.New().String()
+		if c.inBoost {
+			fb.AddDeal(svc.Deal{
+				ID:            ids[i],
+				PieceCid:      "baga-" + ids[i],
+				ClientAddress: "f1aaa",
+				PieceSize:     fakeboost.PieceSize(1 << 20),
+				Checkpoint:    "AddedPiece",
+				Message:       c.message,
+			})
+		}
+		if err := didb.InsertDeal(ids[i], "baga-"+ids[i], "test", true, string(ModeDefault), "", 1<<20, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	NewDealReconciler(cfg, didb).reconcileImportedDeals()
+
+	states := make(map[string]string)
+	for _, state := range []string{db.PENDING, db.SUCCESS, db.FAILURE} {
+		deals, err := didb.GetDeals(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range *deals {
+			states[d.DealUuid] = d.State
+		}
+	}
+
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if states[ids[i]] != c.expected {
+				t.Errorf("expected state %s, got %q", c.expected, states[ids[i]])
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package daemon
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/application-research/delta-importer/daemon/api"
+)
+
+type SchedulePolicy string
+
+const (
+	// Fill import slots from the highest priority dataset first, falling back to file order
+	SchedulePriority SchedulePolicy = "priority"
+	// Share import slots between datasets in proportion to their weight (smooth weighted round-robin)
+	ScheduleWeighted SchedulePolicy = "weighted"
+)
+
+// Scheduler decides which dataset each import slot goes to
+// Weighted round-robin state is kept between importer cycles, so shares even out over time even when only one deal is imported per cycle
+type Scheduler struct {
+	policy  SchedulePolicy
+	mu      sync.Mutex
+	current map[string]int
+	queued  map[string]int
+	known   []Dataset
+}
+
+func NewScheduler(policy SchedulePolicy) *Scheduler {
+	return &Scheduler{
+		policy:  policy,
+		current: make(map[string]int),
+		queued:  make(map[string]int),
+	}
+}
+
+// Fill the import queue from the datasets according to the scheduling policy
+// queueFor should queue imports for a dataset (up to the queue's dataset limit), returning the number queued
+func (s *Scheduler) fill(q *importQueue, datasets []Dataset, queueFor func(ds Dataset) int) {
+	s.mu.Lock()
+	s.known = datasets
+	s.mu.Unlock()
+
+	switch s.policy {
+	case ScheduleWeighted:
+		// Hand out one slot at a time. Datasets with nothing left to import drop out for the rest of the cycle
+		active := append([]Dataset(nil), datasets...)
+		for !q.done() && len(active) > 0 {
+			i := s.nextWeighted(active)
+			q.datasetLimit = 1
+			if n := queueFor(active[i]); n > 0 {
+				s.record(active[i].Dataset, n)
+			} else {
+				active = append(active[:i], active[i+1:]...)
+			}
+		}
+	default:
+		for _, ds := range byPriority(datasets) {
+			if q.done() {
+				break
+			}
+			q.datasetLimit = q.remaining
+			s.record(ds.Dataset, queueFor(ds))
+		}
+	}
+}
+
+// Picks the index of the next dataset using smooth weighted round-robin
+func (s *Scheduler) nextWeighted(active []Dataset) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := 0
+	best := 0
+	for i, ds := range active {
+		s.current[ds.Dataset] += int(ds.Weight)
+		total += int(ds.Weight)
+		if s.current[ds.Dataset] > s.current[active[best].Dataset] {
+			best = i
+		}
+	}
+	s.current[active[best].Dataset] -= total
+
+	return best
+}
+
+func (s *Scheduler) record(dataset string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued[dataset] += n
+}
+
+// Sorts datasets by descending priority. Datasets with equal priority stay in file order
+func byPriority(datasets []Dataset) []Dataset {
+	sorted := append([]Dataset(nil), datasets...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+	return sorted
+}
+
+// Stats returns the policy, and each dataset's target and actual share of imports since the daemon started
+func (s *Scheduler) Stats() api.ScheduleStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := api.ScheduleStats{Policy: string(s.policy)}
+
+	totalWeight, totalQueued := 0, 0
+	for _, ds := range s.known {
+		totalWeight += int(ds.Weight)
+		totalQueued += s.queued[ds.Dataset]
+	}
+
+	datasets := s.known
+	if s.policy != ScheduleWeighted {
+		datasets = byPriority(datasets)
+	}
+
+	for _, ds := range datasets {
+		share := api.DatasetShare{
+			Dataset:  ds.Dataset,
+			Priority: ds.Priority,
+			Weight:   ds.Weight,
+			Imports:  s.queued[ds.Dataset],
+		}
+		if s.policy == ScheduleWeighted && totalWeight > 0 {
+			share.TargetShare = float64(ds.Weight) / float64(totalWeight)
+		}
+		if totalQueued > 0 {
+			share.ActualShare = float64(s.queued[ds.Dataset]) / float64(totalQueued)
+		}
+		stats.Datasets = append(stats.Datasets, share)
+	}
+
+	return stats
+}
@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSchedulerFill(t *testing.T) {
+	cases := []struct {
+		name      string
+		policy    SchedulePolicy
+		datasets  []Dataset
+		available map[string]int // Deals each dataset has to import, unlimited if not listed
+		cycles    int
+		slots     int // Import slots per cycle
+		expected  string
+	}{
+		{
+			name:     "weighted shares slots by weight",
+			policy:   ScheduleWeighted,
+			datasets: []Dataset{{Dataset: "a", Weight: 3}, {Dataset: "b", Weight: 1}},
+			cycles:   1,
+			slots:    8,
+			expected: "a a b a a a b a",
+		},
+		{
+			name:     "equal weights take turns",
+			policy:   ScheduleWeighted,
+			datasets: []Dataset{{Dataset: "a", Weight: 1}, {Dataset: "b", Weight: 1}, {Dataset: "c", Weight: 1}},
+			cycles:   1,
+			slots:    6,
+			expected: "a b c a b c",
+		},
+		{
+			name:     "weighted state is kept between cycles",
+			policy:   ScheduleWeighted,
+			datasets: []Dataset{{Dataset: "a", Weight: 3}, {Dataset: "b", Weight: 1}},
+			cycles:   4,
+			slots:    1,
+			expected: "a a b a",
+		},
+		{
+			name:      "weighted dataset with nothing to import drops out",
+			policy:    ScheduleWeighted,
+			datasets:  []Dataset{{Dataset: "a", Weight: 1}, {Dataset: "b", Weight: 5}},
+			available: map[string]int{"b": 1},
+			cycles:    1,
+			slots:     4,
+			expected:  "b a a a",
+		},
+		{
+			name:      "priority fills from the highest priority dataset first",
+			policy:    SchedulePriority,
+			datasets:  []Dataset{{Dataset: "a", Priority: 1}, {Dataset: "b", Priority: 2}, {Dataset: "c", Priority: 1}},
+			available: map[string]int{"b": 2, "a": 1},
+			cycles:    1,
+			slots:     5,
+			expected:  "b b a c c",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := NewScheduler(c.policy)
+			available := make(map[string]int)
+			for name, n := range c.available {
+				available[name] = n
+			}
+
+			var order []string
+			for i := 0; i < c.cycles; i++ {
+				q := &importQueue{remaining: c.slots}
+				s.fill(q, c.datasets, func(ds Dataset) int {
+					queued := 0
+					for q.datasetLimit > 0 && q.remaining > 0 {
+						if n, limited := available[ds.Dataset]; limited {
+							if n == 0 {
+								break
+							}
+							available[ds.Dataset]--
+						}
+						order = append(order, ds.Dataset)
+						q.remaining--
+						q.datasetLimit--
+						queued++
+					}
+					return queued
+				})
+			}
+
+			if got := strings.Join(order, " "); got != c.expected {
+				t.Errorf("expected slots to go to %q, got %q", c.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package daemon
+
+import (
+	"sort"
+	"time"
+
+	"github.com/application-research/delta-importer/daemon/api"
+	"github.com/application-research/delta-importer/db"
+	svc "github.com/application-research/delta-importer/services"
+	log "github.com/sirupsen/logrus"
+)
+
+// How far back to look for import to proving times
+const SEALING_HISTORY = time.Duration(7 * 24 * time.Hour)
+
+// Most recent deals to base the sealing time on
+const SEALING_HISTORY_DEALS = 200
+
+// Fewest deals that have reached proving before their times are used instead of MIN_SEALING_TIME
+const MIN_SEALING_SAMPLES = 5
+
+// Percentile of recent import to proving times taken as the time to seal a deal that doesn't have to queue
+const SEALING_PERCENTILE = 0.1
+
+// sealingEstimate is how long a deal imported now is expected to take to reach proving
+type sealingEstimate struct {
+	duration   time.Duration // Expected time from import to proving - the larger of sealTime and queueTime
+	sealTime   time.Duration // Time to seal with an empty pipeline. MIN_SEALING_TIME until there are enough samples
+	queueTime  time.Duration // Time to get through the pipeline at its current depth and throughput. 0 if throughput isn't known yet
+	samples    int
+	depth      int
+	throughput float64
+	margin     time.Duration
+}
+
+// Estimate the time to proving from recent import to proving times, and the current pipeline depth and throughput
+// The time through the pipeline follows Little's law - the deals ahead (plus this one) divided by the rate they leave
+func estimateSealing(didb *db.DIDB, depth int, throughput float64, margin time.Duration) sealingEstimate {
+	e := sealingEstimate{sealTime: MIN_SEALING_TIME, depth: depth, throughput: throughput, margin: margin}
+
+	durations, err := didb.GetSealingDurations(now().Add(-SEALING_HISTORY), SEALING_HISTORY_DEALS)
+	if err != nil {
+		log.Errorf("could not get recent sealing times, using %s: %s", MIN_SEALING_TIME, err)
+	}
+	e.samples = len(durations)
+	if e.samples >= MIN_SEALING_SAMPLES {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		e.sealTime = durations[int(SEALING_PERCENTILE*float64(len(durations)-1))]
+	}
+
+	if throughput > 0 {
+		e.queueTime = time.Duration(float64(depth+1) / throughput * float64(time.Hour))
+	}
+
+	e.duration = e.sealTime
+	if e.queueTime > e.duration {
+		e.duration = e.queueTime
+	}
+
+	log.Debugf("estimated %s to proving (seal time %s from %d deals, queue time %s at depth %d)", e.duration.Round(time.Minute), e.sealTime.Round(time.Minute), e.samples, e.queueTime.Round(time.Minute), depth)
+	return e
+}
+
+// Returns true if a deal imported at `at` is expected to reach proving, with the safety margin to spare, before its start epoch
+func (e sealingEstimate) feasible(deal svc.Deal, at time.Time) bool {
+	return deal.StartEpoch.IntoUnix() >= at.Add(e.duration+e.margin).Unix()
+}
+
+func (e sealingEstimate) Stats() api.SealingStats {
+	return api.SealingStats{
+		Estimate:      uint(e.duration.Seconds()),
+		SealTime:      uint(e.sealTime.Seconds()),
+		QueueTime:     uint(e.queueTime.Seconds()),
+		Margin:        uint(e.margin.Seconds()),
+		Samples:       e.samples,
+		PipelineDepth: e.depth,
+		Throughput:    e.throughput,
+	}
+}
@@ -0,0 +1,91 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/application-research/delta-importer/db"
+	svc "github.com/application-research/delta-importer/services"
+	"github.com/application-research/delta-importer/services/fakeboost"
+	"github.com/google/uuid"
+)
+
+func TestEstimateSealing(t *testing.T) {
+	hours := func(n ...int) []time.Duration {
+		var durations []time.Duration
+		for _, h := range n {
+			durations = append(durations, time.Duration(h)*time.Hour)
+		}
+		return durations
+	}
+
+	cases := []struct {
+		name       string
+		sealed     []time.Duration // Import to proving times of deals that reached proving recently
+		sealedAgo  time.Duration   // How long ago they reached proving
+		depth      int
+		throughput float64
+		sealTime   time.Duration
+		queueTime  time.Duration
+		expected   time.Duration
+	}{
+		{"no history", nil, time.Hour, 0, 0, MIN_SEALING_TIME, 0, MIN_SEALING_TIME},
+		{"too few samples", hours(1, 1, 1, 1), time.Hour, 0, 0, MIN_SEALING_TIME, 0, MIN_SEALING_TIME},
+		{"percentile of samples", hours(11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1), time.Hour, 0, 0, 2 * time.Hour, 0, 2 * time.Hour},
+		{"samples too old", hours(1, 1, 1, 1, 1, 1), SEALING_HISTORY + time.Hour, 0, 0, MIN_SEALING_TIME, 0, MIN_SEALING_TIME},
+		{"queue time from depth and throughput", nil, time.Hour, 9, 2, MIN_SEALING_TIME, 5 * time.Hour, 5 * time.Hour},
+		{"seal time when the queue is quicker", hours(3, 3, 3, 3, 3), time.Hour, 9, 10, 3 * time.Hour, time.Hour, 3 * time.Hour},
+		{"empty pipeline still counts the deal itself", nil, time.Hour, 0, 0.1, MIN_SEALING_TIME, 10 * time.Hour, 10 * time.Hour},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			didb, err := db.OpenDIDB(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer didb.Close()
+
+			proving := time.Now().Add(-c.sealedAgo)
+			for _, d := range c.sealed {
+				id := uuid.New().String()
+				if err := didb.InsertDeal(id, "baga-"+id, "test", true, string(ModeDefault), "", 1<<20, proving.Add(-d)); err != nil {
+					t.Fatal(err)
+				}
+				if err := didb.UpdateDeal(id, db.SUCCESS, "", proving); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			e := estimateSealing(didb, c.depth, c.throughput, 30*time.Minute)
+			if e.sealTime != c.sealTime || e.queueTime != c.queueTime || e.duration != c.expected {
+				t.Errorf("expected seal time %s, queue time %s and estimate %s, got %s, %s and %s", c.sealTime, c.queueTime, c.expected, e.sealTime, e.queueTime, e.duration)
+			}
+		})
+	}
+}
+
+func TestSealingEstimateFeasible(t *testing.T) {
+	at := time.Now()
+	e := sealingEstimate{duration: 4 * time.Hour, margin: time.Hour}
+
+	cases := []struct {
+		name     string
+		startIn  time.Duration
+		expected bool
+	}{
+		{"plenty of time", 10 * time.Hour, true},
+		{"within the margin", 4*time.Hour + 30*time.Minute, false},
+		{"before sealing completes", 2 * time.Hour, false},
+		{"start epoch passed", -time.Hour, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			deal := svc.Deal{StartEpoch: fakeboost.StartEpochAt(at.Add(c.startIn))}
+			if got := e.feasible(deal, at); got != c.expected {
+				t.Errorf("expected feasible to be %t, got %t", c.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package daemon
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Where carfiles are found within a dataset dir when no shard templates are given
+const DEFAULT_SHARD_TEMPLATE = "{piece_cid}.car"
+
+// Matches {piece_cid} or a slice of it, ex. {piece_cid[-4:-2]}. {pieceCid} is accepted as well
+var reShardPlaceholder = regexp.MustCompile(`\{(?:piece_cid|pieceCid)(?:\[(-?\d*):(-?\d*)\])?\}`)
+
+// A shard template gives the path of a carfile relative to a dataset dir, ex. "{piece_cid[-4:-2]}/{piece_cid[-2:]}/{piece_cid}.car"
+// Slices work like Go/Python slices of the piece cid, and negative indexes count back from the end
+type shardTemplate string
+
+// Check the template only uses known placeholders, and stays within the dataset dir
+func (t shardTemplate) validate() error {
+	rest := reShardPlaceholder.ReplaceAllString(string(t), "")
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("shard template %q has an unknown placeholder - only {piece_cid} and {piece_cid[start:end]} are supported", t)
+	}
+	if !reShardPlaceholder.MatchString(string(t)) {
+		return fmt.Errorf("shard template %q must contain {piece_cid}", t)
+	}
+	if filepath.IsAbs(string(t)) || strings.HasPrefix(filepath.Clean(string(t)), "..") {
+		return fmt.Errorf("shard template %q must be relative to the dataset dir", t)
+	}
+
+	return nil
+}
+
+// Path of the carfile for a piece cid, relative to the dataset dir
+func (t shardTemplate) expand(pieceCid string) string {
+	return reShardPlaceholder.ReplaceAllStringFunc(string(t), func(m string) string {
+		sub := reShardPlaceholder.FindStringSubmatch(m)
+		if !strings.Contains(m, "[") {
+			return pieceCid
+		}
+		start := sliceIndex(sub[1], 0, len(pieceCid))
+		end := sliceIndex(sub[2], len(pieceCid), len(pieceCid))
+		if start >= end {
+			return ""
+		}
+		return pieceCid[start:end]
+	})
+}
+
+// Number of directories below the dataset dir the template places carfiles
+func (t shardTemplate) depth() int {
+	return strings.Count(filepath.ToSlash(filepath.Clean(string(t))), "/")
+}
+
+// Resolve a slice index, defaulting to def if empty, counting back from the end if negative, and clamping to [0, length]
+func sliceIndex(s string, def int, length int) int {
+	if s == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return def
+	}
+	if i < 0 {
+		i += length
+	}
+	if i < 0 {
+		return 0
+	}
+	if i > length {
+		return length
+	}
+	return i
+}
@@ -0,0 +1,54 @@
+package daemon
+
+import "testing"
+
+func TestShardTemplateExpand(t *testing.T) {
+	const pieceCid = "baga6ea4seaqabcdef"
+
+	cases := []struct {
+		name     string
+		template shardTemplate
+		expected string
+	}{
+		{"default", DEFAULT_SHARD_TEMPLATE, "baga6ea4seaqabcdef.car"},
+		{"camel case placeholder", "{pieceCid}.car", "baga6ea4seaqabcdef.car"},
+		{"negative slices", "{piece_cid[-4:-2]}/{piece_cid[-2:]}/{piece_cid}.car", "cd/ef/baga6ea4seaqabcdef.car"},
+		{"positive slice", "{piece_cid[4:8]}/{piece_cid}.car", "6ea4/baga6ea4seaqabcdef.car"},
+		{"open start", "{piece_cid[:4]}/{piece_cid}.car", "baga/baga6ea4seaqabcdef.car"},
+		{"whole cid", "{piece_cid[:]}.car", "baga6ea4seaqabcdef.car"},
+		{"end past the cid is clamped", "{piece_cid[-2:100]}/{piece_cid}.car", "ef/baga6ea4seaqabcdef.car"},
+		{"start before the cid is clamped", "{piece_cid[-100:4]}/{piece_cid}.car", "baga/baga6ea4seaqabcdef.car"},
+		{"empty slice", "{piece_cid[8:4]}x/{piece_cid}.car", "x/baga6ea4seaqabcdef.car"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.template.expand(pieceCid); got != c.expected {
+				t.Errorf("expected %q, got %q", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestShardTemplateValidate(t *testing.T) {
+	cases := []struct {
+		name     string
+		template shardTemplate
+		valid    bool
+	}{
+		{"default", DEFAULT_SHARD_TEMPLATE, true},
+		{"sliced", "{piece_cid[-4:-2]}/{piece_cid[-2:]}/{piece_cid}.car", true},
+		{"unknown placeholder", "{dataset}/{piece_cid}.car", false},
+		{"no piece cid", "carfile.car", false},
+		{"absolute", "/data/{piece_cid}.car", false},
+		{"outside the dataset dir", "../{piece_cid}.car", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.template.validate(); (err == nil) != c.valid {
+				t.Errorf("expected valid to be %t, got %v", c.valid, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package daemon
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/application-research/delta-importer/daemon/api"
+	"github.com/application-research/delta-importer/db"
+	svc "github.com/application-research/delta-importer/services"
+	"github.com/application-research/delta-importer/services/fakeboost"
+	"github.com/application-research/delta-importer/services/fakeddm"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often (in real time) the simulated sealing pipeline is advanced
+const SIMULATION_TICK = 10 * time.Millisecond
+
+type SimulationConfig struct {
+	Config          Config // Importer settings, as the daemon would run with them
+	DatasetsFile    string
+	Duration        time.Duration // Simulated time to run for
+	Speed           float64       // Simulated seconds per real second
+	DealsPerDataset int
+	CarSize         int64
+	Sealers         int           // Number of deals that can be sealed in parallel
+	SealTime        time.Duration // Simulated time for a deal to go from sealing to proving
+	StartWindow     time.Duration // Default mode deals have start epochs spread randomly across this window
+	Seed            int64
+}
+
+type SimulationReport struct {
+	Duration          time.Duration     `json:"duration"`
+	DealsImported     int               `json:"deals_imported"`
+	BytesImported     int64             `json:"bytes_imported"`
+	DealsProving      int               `json:"deals_proving"`
+	BytesProving      int64             `json:"bytes_proving"`
+	MissedImported    int               `json:"missed_start_epoch_imported"`
+	MissedNotImported int               `json:"missed_start_epoch_not_imported"`
+	Schedule          api.ScheduleStats `json:"schedule"`
+	Pacing            api.PacingStats   `json:"pacing"`
+	PipelineDepth     []PipelineSample  `json:"pipeline_depth"`
+}
+
+type PipelineSample struct {
+	Elapsed  time.Duration `json:"elapsed"`
+	Depth    int           `json:"depth"`
+	Interval time.Duration `json:"interval"` // Time between import cycles
+}
+
+// Bytes imported per simulated day
+func (r *SimulationReport) ImportedPerDay() int64 {
+	return perDay(r.BytesImported, r.Duration)
+}
+
+// Bytes that reached proving per simulated day
+func (r *SimulationReport) ProvingPerDay() int64 {
+	return perDay(r.BytesProving, r.Duration)
+}
+
+func perDay(bytes int64, d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(float64(bytes) / d.Hours() * 24)
+}
+
+// RunSimulation runs the real importer and reconciler against a fake Boost (and fake DDM for pull modes),
+// with generated deals and carfiles for each dataset, over accelerated time
+func RunSimulation(sc SimulationConfig) (*SimulationReport, error) {
+	tmpDir, err := os.MkdirTemp("", "delta-importer-sim")
+	if err != nil {
+		return nil, fmt.Errorf("could not create simulation dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	datasets, err := LoadDatasetsFromFile(sc.DatasetsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Accelerated clock, starting from the current real time
+	realStart := time.Now()
+	simNow := func() time.Time {
+		return realStart.Add(time.Duration(float64(time.Since(realStart)) * sc.Speed))
+	}
+
+	fb, err := fakeboost.New()
+	if err != nil {
+		return nil, fmt.Errorf("could not start fake boost: %w", err)
+	}
+	defer fb.Close()
+
+	// Generate sparse carfiles for each dataset, and (in default mode) a deal for each one
+	rng := rand.New(rand.NewSource(sc.Seed))
+	pieces := make(map[string][]string)
+
+	for i := range datasets {
+		ds := &datasets[i]
+		name := ds.Dataset
+		if len(ds.Addresses) == 0 {
+			return nil, fmt.Errorf("dataset %s has no addresses", name)
+		}
+
+		ds.Dir = filepath.Join(tmpDir, fmt.Sprintf("%x", sha256.Sum256([]byte(name))))
+		ds.Dirs = nil
+		ds.manifest = nil
+		if err := os.MkdirAll(ds.Dir, 0755); err != nil {
+			return nil, err
+		}
+
+		for i := 0; i < sc.DealsPerDataset; i++ {
+			pieceCid := fmt.Sprintf("baga6ea4seaq%x", sha256.Sum256([]byte(fmt.Sprintf("%s-%d", name, i))))
+			if err := createSparseFile(ds.GenerateCarFileName(pieceCid), sc.CarSize); err != nil {
+				return nil, err
+			}
+			pieces[name] = append(pieces[name], pieceCid)
+
+			if sc.Config.Mode == ModeDefault {
+				startOffset := time.Duration(rng.Int63n(int64(sc.StartWindow)) + 1)
+				fb.AddDeal(svc.Deal{
+					ID:            uuid.New().String(),
+					PieceCid:      pieceCid,
+					IsOffline:     true,
+					ClientAddress: ds.Addresses[0],
+					PieceSize:     fakeboost.PieceSize(paddedPieceSize(sc.CarSize)),
+					Checkpoint:    "Accepted",
+					StartEpoch:    fakeboost.StartEpochAt(realStart.Add(startOffset)),
+					CreatedAt:     realStart.Add(-time.Duration(sc.DealsPerDataset-i) * time.Minute),
+				})
+			}
+		}
+	}
+
+	// The simulation provides Boost, DDM and the data dir, and carfiles are generated where they are imported from
+	cfg := sc.Config
+	cfg.BoostAddress = fb.Address()
+	cfg.BoostPort = fb.Port()
+	cfg.BoostGqlPort = fb.Port()
+	cfg.BoostAPIKey = "simulation"
+	cfg.DDMURL = ""
+	cfg.DDMToken = ""
+	cfg.DataDir = tmpDir
+	cfg.StagingDir = ""
+	cfg.StagingDirs = nil
+	cfg.Prefetch = 0
+	cfg.VerifyCommP = false
+	cfg.DeleteAfterImport = false
+
+	if cfg.Mode == ModePullCID || cfg.Mode == ModePullDataset {
+		ddm, err := fakeddm.New("simulation", simulatedDealMaker(fb, datasets, pieces, paddedPieceSize(sc.CarSize), simNow))
+		if err != nil {
+			return nil, fmt.Errorf("could not start fake ddm: %w", err)
+		}
+		defer ddm.Close()
+
+		cfg.DDMURL = ddm.URL()
+		cfg.DDMToken = "simulation"
+	}
+
+	didb, err := db.OpenDIDB(tmpDir)
+	if err != nil {
+		return nil, fmt.Errorf("error opening db: %w", err)
+	}
+	defer didb.Close()
+
+	boost, err := svc.NewBoostConnection(cfg.BoostAddress, cfg.BoostPort, cfg.BoostGqlPort, cfg.BoostAPIKey, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer boost.Close()
+
+	// Swap in the accelerated clock for the importer
+	prevNow, prevRetry := now, svc.WaitForDealRetryInterval
+	now = simNow
+	svc.WaitForDealRetryInterval = time.Duration(float64(svc.WaitForDealRetryInterval) / sc.Speed)
+	defer func() {
+		now, svc.WaitForDealRetryInterval = prevNow, prevRetry
+	}()
+
+	sealer := fb.NewSealer(sc.Sealers, sc.SealTime, simNow)
+	sched := NewScheduler(cfg.Schedule)
+	pace := newPacer(cfg, didb)
+	dr := NewDealReconciler(cfg, didb)
+	report := &SimulationReport{Duration: sc.Duration}
+
+	importInterval := time.Second * time.Duration(cfg.Interval)
+	sampleInterval := sc.Duration / 48
+	if sampleInterval < time.Hour {
+		sampleInterval = time.Hour
+	}
+
+	end := realStart.Add(sc.Duration)
+	nextImport, nextReconcile, nextSample := realStart, realStart, realStart
+
+	ticker := time.NewTicker(SIMULATION_TICK)
+	defer ticker.Stop()
+
+	for t := simNow(); t.Before(end); t = simNow() {
+		sealer.Step()
+
+		if !t.Before(nextSample) {
+			inPipeline, err := boost.GetDealsInPipeline()
+			if err != nil {
+				return nil, fmt.Errorf("could not read the fake boost pipeline: %w", err)
+			}
+			report.PipelineDepth = append(report.PipelineDepth, PipelineSample{
+				Elapsed:  t.Sub(realStart).Truncate(time.Minute),
+				Depth:    len(inPipeline),
+				Interval: pace.wait().Truncate(time.Second),
+			})
+			nextSample = nextSample.Add(sampleInterval)
+		}
+
+		if !t.Before(nextImport) {
+			importer(context.Background(), nil, cfg, didb, sched, pace, nil, datasets)
+			nextImport = t.Add(pace.wait())
+		}
+
+		if !t.Before(nextReconcile) {
+			dr.reconcileImportedDeals()
+			nextReconcile = t.Add(importInterval * 5)
+		}
+
+		<-ticker.C
+	}
+	sealer.Step()
+
+	for _, d := range fb.Deals() {
+		imported := d.InboundFilePath != ""
+		if imported {
+			report.DealsImported++
+		}
+		switch {
+		case d.Message == "Sealer: Proving":
+			report.DealsProving++
+		case d.Err == fakeboost.START_EPOCH_PASSED && imported:
+			report.MissedImported++
+		case d.Err == fakeboost.START_EPOCH_PASSED:
+			report.MissedNotImported++
+		}
+	}
+	report.BytesImported = int64(report.DealsImported) * sc.CarSize
+	report.BytesProving = int64(report.DealsProving) * sc.CarSize
+	report.Schedule = sched.Stats()
+	report.Pacing = pace.Stats()
+
+	return report, nil
+}
+
+// Makes deals in the fake boost in response to DDM self-service requests, using the generated pieces for each dataset
+func simulatedDealMaker(fb *fakeboost.FakeBoost, datasets []Dataset, pieces map[string][]string, pieceSize uint64, simNow func() time.Time) fakeddm.DealMaker {
+	var mu sync.Mutex
+	dealt := make(map[string]bool)
+	byName := make(map[string]Dataset)
+	for _, ds := range datasets {
+		byName[ds.Dataset] = ds
+	}
+
+	return func(req fakeddm.Request) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var dataset, pieceCid string
+		if req.Dataset != "" {
+			dataset = req.Dataset
+			for _, p := range pieces[dataset] {
+				if !dealt[p] {
+					pieceCid = p
+					break
+				}
+			}
+		} else {
+			for name, ps := range pieces {
+				for _, p := range ps {
+					if p == req.Cid {
+						dataset, pieceCid = name, p
+					}
+				}
+			}
+			if dealt[pieceCid] {
+				return "", fmt.Errorf("cid %s has already been dealt", req.Cid)
+			}
+		}
+
+		ds, ok := byName[dataset]
+		if !ok {
+			return "", fmt.Errorf("dataset %s not found", dataset)
+		}
+		if pieceCid == "" {
+			return "", nil
+		}
+
+		dealt[pieceCid] = true
+		fb.AddDeal(svc.Deal{
+			ID:            uuid.New().String(),
+			PieceCid:      pieceCid,
+			IsOffline:     true,
+			ClientAddress: ds.Addresses[0],
+			PieceSize:     fakeboost.PieceSize(pieceSize),
+			Checkpoint:    "Accepted",
+			StartEpoch:    fakeboost.StartEpochAt(simNow().Add(time.Duration(req.StartEpochDelay) * 24 * time.Hour)),
+			CreatedAt:     simNow(),
+		})
+
+		return pieceCid, nil
+	}
+}
+
+// Size of the piece for a carfile - padded with 1 bit in every 128, then up to the next power of 2
+func paddedPieceSize(carSize int64) uint64 {
+	padded := uint64(carSize) + uint64(carSize)/127
+	size := uint64(128)
+	for size < padded {
+		size *= 2
+	}
+	return size
+}
+
+// Creates a file of the given size without allocating any disk space for it
+func createSparseFile(path string, size int64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+
+	log.Tracef("created sparse file %s", path)
+	return nil
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// An import attempt for a piece, kept so that failed pieces are retried with backoff across restarts
+type ImportAttempt struct {
+	PieceCid     string    `json:"piece_cid"`
+	Dataset      string    `json:"dataset"`
+	Attempts     int       `json:"attempts"`
+	LastError    string    `json:"last_error"`
+	LastAttempt  time.Time `json:"last_attempt"`
+	NextEligible time.Time `json:"next_eligible"`
+}
+
+// Get the attempt history for a piece. Returns nil if it has never been attempted
+func (d *DIDB) GetImportAttempt(pieceCid string) (*ImportAttempt, error) {
+	var a ImportAttempt
+	err := d.db.QueryRow("SELECT piece_cid, dataset, attempts, last_error, last_attempt, next_eligible FROM import_attempts WHERE piece_cid = ?", pieceCid).
+		Scan(&a.PieceCid, &a.Dataset, &a.Attempts, &a.LastError, &a.LastAttempt, &a.NextEligible)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get import attempt: %w", err)
+	}
+
+	return &a, nil
+}
+
+// List the attempt history for every piece, or only pieces in dataset if it is not empty
+func (d *DIDB) GetImportAttempts(dataset string) ([]ImportAttempt, error) {
+	q := "SELECT piece_cid, dataset, attempts, last_error, last_attempt, next_eligible FROM import_attempts"
+	var args []interface{}
+	if dataset != "" {
+		q += " WHERE dataset = ?"
+		args = append(args, dataset)
+	}
+	q += " ORDER BY last_attempt DESC"
+
+	rows, err := d.db.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("get import attempts: %w", err)
+	}
+	defer rows.Close()
+
+	attempts := []ImportAttempt{}
+	for rows.Next() {
+		var a ImportAttempt
+		err = rows.Scan(&a.PieceCid, &a.Dataset, &a.Attempts, &a.LastError, &a.LastAttempt, &a.NextEligible)
+		if err != nil {
+			return nil, fmt.Errorf("scan import attempts: %w", err)
+		}
+		attempts = append(attempts, a)
+	}
+
+	return attempts, rows.Err()
+}
+
+// Record an attempt to import a piece, incrementing its attempt count
+func (d *DIDB) RecordImportAttempt(pieceCid string, dataset string, lastError string, at time.Time, nextEligible time.Time) error {
+	_, err := d.db.Exec(`
+		INSERT INTO import_attempts (piece_cid, dataset, attempts, last_error, last_attempt, next_eligible)
+		VALUES (?, ?, 1, ?, ?, ?)
+		ON CONFLICT (piece_cid) DO UPDATE SET
+			dataset = excluded.dataset,
+			attempts = attempts + 1,
+			last_error = excluded.last_error,
+			last_attempt = excluded.last_attempt,
+			next_eligible = excluded.next_eligible`,
+		pieceCid, dataset, lastError, at, nextEligible)
+
+	if err != nil {
+		return fmt.Errorf("record import attempt: %w", err)
+	}
+	return nil
+}
+
+// Set the error for the most recent attempt to import a piece
+func (d *DIDB) UpdateImportAttemptError(pieceCid string, lastError string) error {
+	_, err := d.db.Exec("UPDATE import_attempts SET last_error = ? WHERE piece_cid = ?", lastError, pieceCid)
+
+	if err != nil {
+		return fmt.Errorf("update import attempt: %w", err)
+	}
+	return nil
+}
+
+// Clear the attempt history for a piece, a dataset, or both (pieces matching both). Returns the number of pieces cleared
+func (d *DIDB) ClearImportAttempts(pieceCid string, dataset string) (int64, error) {
+	if pieceCid == "" && dataset == "" {
+		return 0, fmt.Errorf("clear import attempts: a piece cid or dataset is required")
+	}
+
+	q := "DELETE FROM import_attempts WHERE 1 = 1"
+	var args []interface{}
+	if pieceCid != "" {
+		q += " AND piece_cid = ?"
+		args = append(args, pieceCid)
+	}
+	if dataset != "" {
+		q += " AND dataset = ?"
+		args = append(args, dataset)
+	}
+
+	res, err := d.db.Exec(q, args...)
+	if err != nil {
+		return 0, fmt.Errorf("clear import attempts: %w", err)
+	}
+
+	return res.RowsAffected()
+}
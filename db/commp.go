@@ -0,0 +1,42 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Get the piece cid and padded piece size previously computed for a file
+// Only returns a result if the file has the same size and modification time as when it was computed
+func (d *DIDB) GetCachedCommP(filePath string, size int64, modTime time.Time) (string, uint64, bool, error) {
+	var pieceCid string
+	var pieceSize uint64
+	err := d.db.QueryRow("SELECT piece_cid, piece_size FROM commp_cache WHERE file_path = ? AND size = ? AND mod_time = ?", filePath, size, modTime.UnixNano()).
+		Scan(&pieceCid, &pieceSize)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, false, nil
+	}
+	if err != nil {
+		return "", 0, false, fmt.Errorf("get cached commp: %w", err)
+	}
+
+	return pieceCid, pieceSize, true, nil
+}
+
+// Store the piece cid and padded piece size computed for a file
+func (d *DIDB) CacheCommP(filePath string, size int64, modTime time.Time, pieceCid string, pieceSize uint64) error {
+	_, err := d.db.Exec(`
+		INSERT INTO commp_cache (file_path, size, mod_time, piece_cid, piece_size) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (file_path) DO UPDATE SET
+			size = excluded.size,
+			mod_time = excluded.mod_time,
+			piece_cid = excluded.piece_cid,
+			piece_size = excluded.piece_size`,
+		filePath, size, modTime.UnixNano(), pieceCid, pieceSize)
+
+	if err != nil {
+		return fmt.Errorf("cache commp: %w", err)
+	}
+	return nil
+}
@@ -2,10 +2,41 @@ CREATE TABLE IF NOT EXISTS imported_deals (
   id integer PRIMARY KEY AUTOINCREMENT,
   deal_uuid VARCHAR(255),
   comm_p VARCHAR(255) NOT NULL,
+  dataset VARCHAR(255) NOT NULL DEFAULT '',
   state VARCHAR(255) NOT NULL,
   mode VARCHAR(255) NOT NULL,
   size BIGINT,
   message TEXT,
   published BOOLEAN DEFAULT FALSE,
-  created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-);
\ No newline at end of file
+  created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  updated_date TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS import_attempts (
+  piece_cid VARCHAR(255) PRIMARY KEY,
+  dataset VARCHAR(255) NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  last_error TEXT NOT NULL DEFAULT '',
+  last_attempt TIMESTAMP NOT NULL,
+  next_eligible TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS commp_cache (
+  file_path TEXT PRIMARY KEY,
+  size BIGINT NOT NULL,
+  mod_time BIGINT NOT NULL,
+  piece_cid VARCHAR(255) NOT NULL,
+  piece_size BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS expiring_deals (
+  deal_uuid VARCHAR(255) PRIMARY KEY,
+  piece_cid VARCHAR(255) NOT NULL,
+  dataset VARCHAR(255) NOT NULL,
+  client_address VARCHAR(255) NOT NULL DEFAULT '',
+  start_epoch BIGINT NOT NULL,
+  start_time TIMESTAMP NOT NULL,
+  reason TEXT NOT NULL DEFAULT '',
+  first_seen TIMESTAMP NOT NULL,
+  last_seen TIMESTAMP NOT NULL
+);
@@ -19,6 +19,7 @@ type DbImportedDeal struct {
 	Id          int    `json:"id"`
 	DealUuid    string `json:"deal_uuid"`
 	CommP       string `json:"comm_p"`
+	Dataset     string `json:"dataset"`
 	State       string `json:"state"`
 	Mode        string `json:"mode"`
 	Size        int64  `json:"size"`
@@ -53,25 +54,75 @@ func OpenDIDB(root string) (*DIDB, error) {
 	}, nil
 }
 
-// Create the initial DB tables to set up a brand new db
+// Close the database, flushing any pending writes
+func (d *DIDB) Close() error {
+	return d.db.Close()
+}
+
+// Create the initial DB tables to set up a brand new db, and add any columns missing from an older db
 func setUpDBTables(db *sql.DB) error {
 	_, err := db.Exec(fmt.Sprintf(dbSchema))
 	if err != nil {
 		return err
 	}
 
+	err = addColumnIfMissing(db, "imported_deals", "dataset", "VARCHAR(255) NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(db, "imported_deals", "updated_date", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CREATE TABLE IF NOT EXISTS won't add columns to an existing table, so add them here
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("get columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return fmt.Errorf("scan columns of %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("get columns of %s: %w", table, err)
+	}
+
+	log.Infof("adding column %s to %s", column, table)
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("add column %s to %s: %w", column, table, err)
+	}
+
 	return nil
 }
 
+// Format of created_date, matching sqlite's CURRENT_TIMESTAMP
+const TIMESTAMP_FORMAT = "2006-01-02 15:04:05"
+
 // Store a deal in the DI database
-func (d *DIDB) InsertDeal(dealUuid string, commP string, success bool, mode string, message string, size int64) error {
+func (d *DIDB) InsertDeal(dealUuid string, commP string, dataset string, success bool, mode string, message string, size int64, created time.Time) error {
 	var state string
 	if success {
 		state = PENDING
 	} else {
 		state = FAILURE
 	}
-	_, err := d.db.Exec("INSERT INTO imported_deals (deal_uuid, comm_p, state, mode, message, size) VALUES (?, ?, ?, ?, ?, ?)", dealUuid, commP, state, mode, message, size)
+	_, err := d.db.Exec("INSERT INTO imported_deals (deal_uuid, comm_p, dataset, state, mode, message, size, created_date) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", dealUuid, commP, dataset, state, mode, message, size, created.UTC().Format(TIMESTAMP_FORMAT))
 
 	if err != nil {
 		return fmt.Errorf("insert deal: %w", err)
@@ -79,8 +130,8 @@ func (d *DIDB) InsertDeal(dealUuid string, commP string, success bool, mode stri
 	return nil
 }
 
-func (d *DIDB) UpdateDeal(dealUuid string, state string, message string) error {
-	_, err := d.db.Exec("UPDATE imported_deals SET state = ?, message = ? WHERE deal_uuid = ?", state, message, dealUuid)
+func (d *DIDB) UpdateDeal(dealUuid string, state string, message string, updated time.Time) error {
+	_, err := d.db.Exec("UPDATE imported_deals SET state = ?, message = ?, updated_date = ? WHERE deal_uuid = ?", state, message, updated.UTC().Format(TIMESTAMP_FORMAT), dealUuid)
 
 	if err != nil {
 		return fmt.Errorf("update deal: %w", err)
@@ -141,12 +192,14 @@ func (d *DIDB) GetDealStats() (DealStats, error) {
 func (d *DIDB) GetDeals(state string) (*[]DbImportedDeal, error) {
 	var deals []DbImportedDeal
 
-	q := "SELECT * FROM imported_deals"
+	q := "SELECT id, deal_uuid, comm_p, dataset, state, mode, size, message, published, created_date FROM imported_deals"
+	var args []interface{}
 	if state != "" {
 		q += " WHERE state = ?"
+		args = append(args, state)
 	}
 
-	rows, err := d.db.Query(q, PENDING)
+	rows, err := d.db.Query(q, args...)
 
 	if err != nil {
 		return nil, fmt.Errorf("get pending deals: %w", err)
@@ -154,7 +207,7 @@ func (d *DIDB) GetDeals(state string) (*[]DbImportedDeal, error) {
 
 	for rows.Next() {
 		var deal DbImportedDeal
-		err = rows.Scan(&deal.Id, &deal.DealUuid, &deal.CommP, &deal.State, &deal.Mode, &deal.Size, &deal.Message, &deal.Published, &deal.CreatedDate)
+		err = rows.Scan(&deal.Id, &deal.DealUuid, &deal.CommP, &deal.Dataset, &deal.State, &deal.Mode, &deal.Size, &deal.Message, &deal.Published, &deal.CreatedDate)
 		if err != nil {
 			return nil, fmt.Errorf("scan pending deals: %w", err)
 		}
@@ -164,3 +217,49 @@ func (d *DIDB) GetDeals(state string) (*[]DbImportedDeal, error) {
 	return &deals, nil
 
 }
+
+// Total bytes (padded piece size) successfully imported for a dataset since the given time
+func (d *DIDB) GetBytesImportedSince(dataset string, since time.Time) (int64, error) {
+	var bytes sql.NullInt64
+	err := d.db.QueryRow("SELECT SUM(size) FROM imported_deals WHERE dataset = ? AND state != ? AND created_date >= ?", dataset, FAILURE, since.UTC().Format(TIMESTAMP_FORMAT)).
+		Scan(&bytes)
+	if err != nil {
+		return 0, fmt.Errorf("get bytes imported: %w", err)
+	}
+
+	return bytes.Int64, nil
+}
+
+// Time from import to proving of the most recent (up to limit) deals to reach proving since the given time
+func (d *DIDB) GetSealingDurations(since time.Time, limit int) ([]time.Duration, error) {
+	rows, err := d.db.Query("SELECT created_date, updated_date FROM imported_deals WHERE state = ? AND updated_date >= ? ORDER BY updated_date DESC LIMIT ?", SUCCESS, since.UTC().Format(TIMESTAMP_FORMAT), limit)
+	if err != nil {
+		return nil, fmt.Errorf("get sealing durations: %w", err)
+	}
+	defer rows.Close()
+
+	var durations []time.Duration
+	for rows.Next() {
+		var created, updated time.Time
+		if err := rows.Scan(&created, &updated); err != nil {
+			return nil, fmt.Errorf("get sealing durations: %w", err)
+		}
+		if updated.After(created) {
+			durations = append(durations, updated.Sub(created))
+		}
+	}
+
+	return durations, rows.Err()
+}
+
+// Number of imported deals that have left the sealing pipeline (succeeded or failed) since the given time
+func (d *DIDB) CountDealsSettledSince(since time.Time) (int, error) {
+	var count int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM imported_deals WHERE state IN (?, ?) AND updated_date >= ?", SUCCESS, FAILURE, since.UTC().Format(TIMESTAMP_FORMAT)).
+		Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("count settled deals: %w", err)
+	}
+
+	return count, nil
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// An offline deal awaiting import that can no longer be sealed before its start epoch
+type ExpiringDeal struct {
+	DealUuid      string    `json:"deal_uuid"`
+	PieceCid      string    `json:"piece_cid"`
+	Dataset       string    `json:"dataset"`
+	ClientAddress string    `json:"client_address"`
+	StartEpoch    int64     `json:"start_epoch"`
+	StartTime     time.Time `json:"start_time"`
+	Reason        string    `json:"reason"`
+	FirstSeen     time.Time `json:"first_seen"`
+	LastSeen      time.Time `json:"last_seen"`
+}
+
+// Record a deal that can no longer make its start epoch, or update the reason and last seen time if it is already recorded
+func (d *DIDB) RecordExpiringDeal(e ExpiringDeal) error {
+	_, err := d.db.Exec(`
+		INSERT INTO expiring_deals (deal_uuid, piece_cid, dataset, client_address, start_epoch, start_time, reason, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (deal_uuid) DO UPDATE SET
+			dataset = excluded.dataset,
+			reason = excluded.reason,
+			last_seen = excluded.last_seen`,
+		e.DealUuid, e.PieceCid, e.Dataset, e.ClientAddress, e.StartEpoch, e.StartTime, e.Reason, e.FirstSeen, e.LastSeen)
+
+	if err != nil {
+		return fmt.Errorf("record expiring deal: %w", err)
+	}
+	return nil
+}
+
+// Remove a deal that is expected to make its start epoch again (ex. the sealing pipeline has drained), or is no longer awaiting import
+func (d *DIDB) RemoveExpiringDeal(dealUuid string) error {
+	_, err := d.db.Exec("DELETE FROM expiring_deals WHERE deal_uuid = ?", dealUuid)
+
+	if err != nil {
+		return fmt.Errorf("remove expiring deal: %w", err)
+	}
+	return nil
+}
+
+// List deals that can no longer make their start epoch, or only deals in dataset if it is not empty. Soonest start epoch first
+func (d *DIDB) GetExpiringDeals(dataset string) ([]ExpiringDeal, error) {
+	q := "SELECT deal_uuid, piece_cid, dataset, client_address, start_epoch, start_time, reason, first_seen, last_seen FROM expiring_deals"
+	var args []interface{}
+	if dataset != "" {
+		q += " WHERE dataset = ?"
+		args = append(args, dataset)
+	}
+	q += " ORDER BY start_epoch ASC"
+
+	rows, err := d.db.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("get expiring deals: %w", err)
+	}
+	defer rows.Close()
+
+	deals := []ExpiringDeal{}
+	for rows.Next() {
+		var e ExpiringDeal
+		err = rows.Scan(&e.DealUuid, &e.PieceCid, &e.Dataset, &e.ClientAddress, &e.StartEpoch, &e.StartTime, &e.Reason, &e.FirstSeen, &e.LastSeen)
+		if err != nil {
+			return nil, fmt.Errorf("scan expiring deals: %w", err)
+		}
+		deals = append(deals, e)
+	}
+
+	return deals, rows.Err()
+}
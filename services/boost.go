@@ -5,7 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/application-research/delta-importer/util"
@@ -16,17 +16,32 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// BoostClient is the set of Boost operations used by the importer and reconciler
+type BoostClient interface {
+	ImportCar(ctx context.Context, carFile string, pieceCid string, dealUuid uuid.UUID) ImportResult
+	GetDeal(dealID string) (Deal, error)
+	GetDealsAwaitingImport(clientAddress []string) (BoostDeals, error)
+	EachDealCompleted(clientAddress string, fn func(Deal)) error
+	GetDealsInPipeline() (BoostDeals, error)
+	GetDealsForContent(cid string) (Deals, error)
+	WaitForDeal(ctx context.Context, pieceCid string) ([]Deal, error)
+	Close()
+}
+
+var _ BoostClient = (*BoostConnection)(nil)
+
 type BoostConnection struct {
 	bapi              bapi.BoostStruct
 	bgql              *graphql.Client
 	close             jsonrpc.ClientCloser
-	stagingDir        string
+	staging           *Staging
 	deleteAfterImport bool
 }
 
 type BoostDeals []Deal
 
-func NewBoostConnection(boostAddress string, boostPort string, gqlPort string, boostAuthToken string, stagingDir string, deleteAfterImport bool) (*BoostConnection, error) {
+// staging may be nil, to import car files from where they are
+func NewBoostConnection(boostAddress string, boostPort string, gqlPort string, boostAuthToken string, staging *Staging, deleteAfterImport bool) (*BoostConnection, error) {
 	headers := http.Header{"Authorization": []string{"Bearer " + boostAuthToken}}
 	ctx := context.Background()
 
@@ -44,7 +59,7 @@ func NewBoostConnection(boostAddress string, boostPort string, gqlPort string, b
 		bapi:              api,
 		bgql:              graphqlClient,
 		close:             close,
-		stagingDir:        stagingDir,
+		staging:           staging,
 		deleteAfterImport: deleteAfterImport,
 	}
 
@@ -65,24 +80,68 @@ type ImportResult struct {
 
 // ImportCar imports a car file into boost
 // Returns the deal uuid, commP, and whether the import was successful along with any error message
-// If stagingDir is set, the car file will be copied to the staging dir before being imported
+// If staging is set, the car file will be copied to a staging dir with room for it before being imported. Compressed car files (.car.zst, .car.gz) are decompressed into it, and can only be imported with staging
 func (bc *BoostConnection) ImportCar(ctx context.Context, carFile string, pieceCid string, dealUuid uuid.UUID) ImportResult {
 	log.Debugf("importing uuid %v from %v", dealUuid, carFile)
+	sourceFile := carFile
 	inStaging := false
 
-	if bc.stagingDir != "" {
-		// Copy car file to staging dir
-		stagingFile := filepath.Join(bc.stagingDir, pieceCid+".car")
-		log.Debugf("copying car file to staging dir %s", stagingFile)
-		err := util.CopyFile(carFile, stagingFile)
+	failed := func(fileSize int64, message string) ImportResult {
+		return ImportResult{
+			Successful: false,
+			DealUuid:   dealUuid.String(),
+			CommP:      pieceCid,
+			FileSize:   fileSize,
+			Message:    message,
+		}
+	}
+
+	compressed := util.IsCompressed(carFile)
+	if compressed && bc.staging == nil {
+		log.Errorf("cannot import compressed car file %s without a staging dir", carFile)
+		return failed(util.FileSize(carFile), "compressed car file can only be imported with a staging dir")
+	}
+
+	// Car files already in the staging dir (ex. downloaded from a remote source) are imported from there
+	alreadyStaged := bc.staging != nil && bc.staging.Contains(carFile)
+
+	if alreadyStaged && !compressed {
+		inStaging = true
+	} else if bc.staging != nil {
+		// Copy (or decompress) car file to a staging dir with room for it, unless the prefetcher already has
+		stagingFile, err := bc.staging.Stage(ctx, carFile, pieceCid+".car")
 		if err != nil {
-			log.Fatalf("failed to copy car file to staging dir: %s", err)
+			if ctx.Err() != nil {
+				log.Errorf("staging of car file %s cancelled: %s", carFile, err)
+				return failed(util.FileSize(carFile), "staging cancelled: "+err.Error())
+			}
+			log.Errorf("could not stage car file %s: %s", carFile, err)
+			return failed(util.FileSize(carFile), "staging failed: "+err.Error())
+		}
+
+		// A compressed car file downloaded into the staging dir isn't needed once it is decompressed
+		if alreadyStaged {
+			if err := util.DeleteFile(sourceFile); err != nil {
+				log.Errorf("failed to delete staged compressed car file: %s", err)
+			}
 		}
 
 		carFile = stagingFile
 		inStaging = true
 	}
 
+	// Size of the car file as imported - decompressed, if it was compressed
+	fileSize := util.FileSize(carFile)
+
+	// Boost only deletes the staged copy if it accepts the deal, otherwise clean it up here
+	removeStaged := func() {
+		if inStaging {
+			if err := util.DeleteFile(carFile); err != nil {
+				log.Errorf("failed to delete staged car file: %s", err)
+			}
+		}
+	}
+
 	// Always delete from staging dir. If not in staging but `deleteAfterImport` set, then make Boost delete it
 	shouldDelete := bc.deleteAfterImport || inStaging
 
@@ -91,31 +150,22 @@ func (bc *BoostConnection) ImportCar(ctx context.Context, carFile string, pieceC
 	rej, err := bc.bapi.BoostOfflineDealWithData(ctx, dealUuid, carFile, shouldDelete)
 	if err != nil {
 		log.Errorf("failed to execute offline deal: %s", err)
-		return ImportResult{
-			Successful: false,
-			DealUuid:   dealUuid.String(),
-			CommP:      pieceCid,
-			FileSize:   util.FileSize(carFile),
-			Message:    err.Error(),
-		}
+		removeStaged()
+		return failed(fileSize, err.Error())
 	}
 	if rej != nil && rej.Reason != "" {
 		log.Errorf("offline deal %s rejected: %s", dealUuid, rej.Reason)
-		return ImportResult{
-			Successful: false,
-			DealUuid:   dealUuid.String(),
-			CommP:      pieceCid,
-			FileSize:   util.FileSize(carFile),
-			Message:    err.Error(),
-		}
+		removeStaged()
+		return failed(fileSize, rej.Reason)
 	}
 
 	log.Printf("offline import for deal UUID "+util.Purple+"%s"+util.Reset+" successful!", dealUuid)
 
 	// Remove the source carfile - staging dir will be taken care of by the `shouldDelete` flag
-	if bc.deleteAfterImport && inStaging {
-		log.Debugf("deleting car file %s", carFile)
-		err = util.DeleteFile(carFile)
+	// A hardlinked or reflinked staged file keeps its own reference to the data, so it isn't affected. Symlinks can't be combined with deleteAfterImport
+	if bc.deleteAfterImport && inStaging && !alreadyStaged {
+		log.Debugf("deleting car file %s", sourceFile)
+		err = util.DeleteFile(sourceFile)
 		if err != nil {
 			log.Errorf("failed to delete car file: %s", err)
 		}
@@ -125,7 +175,7 @@ func (bc *BoostConnection) ImportCar(ctx context.Context, carFile string, pieceC
 		Successful: true,
 		DealUuid:   dealUuid.String(),
 		CommP:      pieceCid,
-		FileSize:   util.FileSize(carFile),
+		FileSize:   fileSize,
 		Message:    "",
 	}
 }
@@ -165,203 +215,189 @@ func (bc *BoostConnection) GetDeal(dealID string) (Deal, error) {
 	return graphqlResponse.Data.Deals[0], nil
 }
 
-// Get deals that are offiline, in the "accepted" state, and not yet imported
-// Clientaddress can be used to filter the deals, but is not required (will return all deals)
-// Note: limits to 100 deals
-func (bc *BoostConnection) GetDealsAwaitingImport(clientAddress []string) BoostDeals {
-	var toImport []Deal
+// Deals requested per page of a Boost deals query
+const BOOST_DEALS_PAGE_SIZE = 1000
+
+// Most pages read for a single deals query. Deals past this are dropped, with a warning
+const BOOST_DEALS_MAX_PAGES = 1000
+
+// Deal fields requested by the deals queries
+const (
+	dealFieldsAwaitingImport = "ID Message PieceCid IsOffline ClientAddress PieceSize Checkpoint StartEpoch InboundFilePath Err CreatedAt"
+	dealFieldsCompleted      = "ID Message PieceCid ClientAddress"
+	dealFieldsPipeline       = "ID Message PieceCid ClientAddress PieceSize"
+	dealFieldsContent        = "ID Message PieceCid IsOffline ClientAddress PieceSize Checkpoint InboundFilePath Err"
+)
+
+// Run a deals query a page at a time, passing each deal to fn as it arrives, until fn returns false or there are no more deals
+// args are the query's filter/query arguments (ex. `filter: {Checkpoint: Accepted}`), fields the deal fields to return
+// Pages after the first are read from a cursor at the first deal, so deals made while paging don't shift the pages
+func (bc *BoostConnection) eachDeal(args []string, fields string, fn func(Deal) bool) error {
+	cursor := ""
+	seen := make(map[string]bool)
+	total := 0
+
+	for page := 0; ; page++ {
+		if page == BOOST_DEALS_MAX_PAGES {
+			log.Warnf("boost deals query (%s) truncated after %d pages: read %d of %d deals", strings.Join(args, ", "), page, len(seen), total)
+			return nil
+		}
+
+		pageArgs := append([]string{}, args...)
+		if cursor != "" {
+			pageArgs = append(pageArgs, fmt.Sprintf("cursor: %q", cursor))
+		}
+		pageArgs = append(pageArgs, fmt.Sprintf("offset: %d", page*BOOST_DEALS_PAGE_SIZE), fmt.Sprintf("limit: %d", BOOST_DEALS_PAGE_SIZE))
 
-	for _, address := range clientAddress {
 		graphqlRequest := graphql.NewRequest(fmt.Sprintf(`
 	{
-		deals(filter: {Checkpoint: Accepted, IsOffline: true}, query: "%s", limit: 100) {
+		deals(%s) {
+			totalCount
+			more
 			deals {
-				ID
-				Message
-				PieceCid
-				IsOffline
-				ClientAddress
-				Checkpoint
-				StartEpoch
-				InboundFilePath
-				Err
+				%s
 			}
 		}
 	}
-	`, address))
+	`, strings.Join(pageArgs, ", "), fields))
 
 		var graphqlResponse DealsResponseJson
 		if err := bc.bgql.Run(context.Background(), graphqlRequest, &graphqlResponse); err != nil {
-			panic(err)
+			if page == 0 {
+				return err
+			}
+			return fmt.Errorf("reading page %d of %d deals: %w", page+1, total, err)
 		}
 
-		for _, deal := range graphqlResponse.Data.Deals {
-			// Only check:
-			// - Deals where the inbound path has not been set (has not been imported yet)
-			// - Deals that are not running CommP verification (this indicates they have already been imported)
-			if deal.InboundFilePath == "" && deal.Message != "Verifying Commp" {
-				toImport = append(toImport, deal)
+		data := graphqlResponse.Data
+		if page == 0 {
+			total = data.TotalCount
+			if len(data.Deals) > 0 {
+				cursor = data.Deals[0].ID
 			}
 		}
 
-	}
-
-	return toImport
-}
-
-func (bc *BoostConnection) GetDealsCompleted(clientAddress string) BoostDeals {
-	graphqlRequest := graphql.NewRequest(fmt.Sprintf(`
-	{
-		deals(filter: {Checkpoint: IndexedAndAnnounced}, query: "%s", limit: 1000000) {
-			deals {
-				ID
-				Message
-				PieceCid
+		for _, deal := range data.Deals {
+			// A deal moving into the queried checkpoint while paging pushes the deals after it onto the next page
+			if seen[deal.ID] {
+				continue
+			}
+			seen[deal.ID] = true
+			if !fn(deal) {
+				return nil
 			}
 		}
-	}
-	`, clientAddress))
 
-	var graphqlResponseCompleted DealsResponseJson
-	if err := bc.bgql.Run(context.Background(), graphqlRequest, &graphqlResponseCompleted); err != nil {
-		panic(err)
-	}
-
-	var completed []Deal
-	for _, deal := range graphqlResponseCompleted.Data.Deals {
-		if deal.Message == "Sealer: Proving" {
-			completed = append(completed, deal)
+		if !data.More || len(data.Deals) == 0 {
+			// Deals moving out of the queried checkpoint while paging pull the deals after them back a page, so they are missed
+			if len(seen) < total {
+				log.Debugf("boost deals query (%s) returned %d of %d deals, as deals changed state while paging", strings.Join(args, ", "), len(seen), total)
+			}
+			return nil
 		}
 	}
-
-	return completed
 }
 
-func (bc *BoostConnection) GetDealsInPipeline() BoostDeals {
-	var inPipeline []Deal
+// Get deals that are offiline, in the "accepted" state, and not yet imported, made from any of the client addresses
+// The Boost query is a free-text search across deal fields, so deals are only kept if their client address matches exactly
+func (bc *BoostConnection) GetDealsAwaitingImport(clientAddress []string) (BoostDeals, error) {
+	var toImport []Deal
 
-	// Deals in active sealing PC1/PC2, Verifying CommP etc
-	graphqlRequestSealing := graphql.NewRequest(`
-	{
-		deals(filter: {Checkpoint: IndexedAndAnnounced}, limit: 2000) {
-			deals {
-				ID
-				Message
-				PieceCid
+	for _, address := range clientAddress {
+		err := bc.eachDeal([]string{"filter: {Checkpoint: Accepted, IsOffline: true}", fmt.Sprintf("query: %q", address)}, dealFieldsAwaitingImport, func(deal Deal) bool {
+			if deal.ClientAddress != address {
+				return true
 			}
-		}
-	}
-	`)
-	var graphqlResponseSealing DealsResponseJson
-	if err := bc.bgql.Run(context.Background(), graphqlRequestSealing, &graphqlResponseSealing); err != nil {
-		panic(err)
-	}
-	for _, deal := range graphqlResponseSealing.Data.Deals {
-		// Disregard deals that are complete (proving), removed, or failed to terminate as they are not in the pipeline
-		if deal.Message != "Sealer: Proving" && deal.Message != "Sealer: Removed" && deal.Message != "Sealer: TerminateFailed" {
-			inPipeline = append(inPipeline, deal)
-		}
-	}
 
-	// Deals awaiting publish
-	graphqlRequestTransferred := graphql.NewRequest(`
-	{
-		deals(filter: {Checkpoint: Transferred}, limit: 2000) {
-			deals {
-				ID
-				Message
-				PieceCid
+			// Only check:
+			// - Deals where the inbound path has not been set (has not been imported yet)
+			// - Deals that are not running CommP verification (this indicates they have already been imported)
+			if deal.InboundFilePath == "" && deal.Message != "Verifying Commp" {
+				toImport = append(toImport, deal)
 			}
-		}
-	}
-	`)
-	var graphqlResponseTransferred DealsResponseJson
-	if err := bc.bgql.Run(context.Background(), graphqlRequestTransferred, &graphqlResponseTransferred); err != nil {
-		panic(err)
-	}
-	for _, deal := range graphqlResponseTransferred.Data.Deals {
-		if deal.Message == "Ready to Publish" {
-			inPipeline = append(inPipeline, deal)
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("get deals awaiting import for %s: %w", address, err)
 		}
 	}
 
-	// Deals awaiting PSD Confirmation
-	graphqlRequestPublished := graphql.NewRequest(`
-	{
-		deals(filter: {Checkpoint: Published}, limit: 2000) {
-			deals {
-				ID
-				Message
-				PieceCid
-			}
+	return toImport, nil
+}
+
+// Passes each deal made from the client address (matched exactly) that has been sealed (is proving) to fn, a page at a time
+func (bc *BoostConnection) EachDealCompleted(clientAddress string, fn func(Deal)) error {
+	err := bc.eachDeal([]string{"filter: {Checkpoint: IndexedAndAnnounced}", fmt.Sprintf("query: %q", clientAddress)}, dealFieldsCompleted, func(deal Deal) bool {
+		if deal.ClientAddress == clientAddress && deal.Message == "Sealer: Proving" {
+			fn(deal)
 		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("get completed deals for %s: %w", clientAddress, err)
 	}
-	`)
-	var graphqlResponsePublished DealsResponseJson
-	if err := bc.bgql.Run(context.Background(), graphqlRequestPublished, &graphqlResponsePublished); err != nil {
-		panic(err)
-	}
-	for _, deal := range graphqlResponsePublished.Data.Deals {
-		if deal.Message == "Awaiting Publish Confirmation" {
-			inPipeline = append(inPipeline, deal)
-		}
+	return nil
+}
+
+func (bc *BoostConnection) GetDealsInPipeline() (BoostDeals, error) {
+	var inPipeline []Deal
+
+	// Each checkpoint, and the deal message that means a deal at that checkpoint is still in the pipeline (empty = see below)
+	checkpoints := []struct {
+		checkpoint string
+		message    string
+	}{
+		// Deals in active sealing PC1/PC2, Verifying CommP etc
+		{"IndexedAndAnnounced", ""},
+		// Deals awaiting publish
+		{"Transferred", "Ready to Publish"},
+		// Deals awaiting PSD Confirmation
+		{"Published", "Awaiting Publish Confirmation"},
+		// Deals in Adding to Sector
+		{"PublishConfirmed", "Adding to Sector"},
 	}
 
-	// Deals in Adding to Sector
-	graphqlRequestPublishConfirmed := graphql.NewRequest(`
-		{
-			deals(filter: {Checkpoint: PublishConfirmed}, limit: 2000) {
-				deals {
-					ID
-					Message
-					PieceCid
+	for _, cp := range checkpoints {
+		err := bc.eachDeal([]string{fmt.Sprintf("filter: {Checkpoint: %s}", cp.checkpoint)}, dealFieldsPipeline, func(deal Deal) bool {
+			if cp.message == "" {
+				// Disregard deals that are complete (proving), removed, or failed to terminate as they are not in the pipeline
+				if deal.Message != "Sealer: Proving" && deal.Message != "Sealer: Removed" && deal.Message != "Sealer: TerminateFailed" {
+					inPipeline = append(inPipeline, deal)
 				}
+			} else if deal.Message == cp.message {
+				inPipeline = append(inPipeline, deal)
 			}
-		}
-		`)
-	var graphqlResponsePublishConfirmed DealsResponseJson
-	if err := bc.bgql.Run(context.Background(), graphqlRequestPublishConfirmed, &graphqlResponsePublishConfirmed); err != nil {
-		panic(err)
-	}
-	for _, deal := range graphqlResponsePublishConfirmed.Data.Deals {
-		if deal.Message == "Adding to Sector" {
-			inPipeline = append(inPipeline, deal)
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("get deals in pipeline: %w", err)
 		}
 	}
 
-	return inPipeline
+	return inPipeline, nil
 }
 
 // Queries boost for deals that match a given CID - useful to check if there are other failed ones
-func (bc *BoostConnection) GetDealsForContent(cid string) Deals {
-	graphqlRequest := graphql.NewRequest(fmt.Sprintf(`
-	{
-		deals(query: "%s", limit: 5) {
-			deals {
-				ID
-				Message
-				PieceCid
-				IsOffline
-				ClientAddress
-				Checkpoint
-				InboundFilePath
-				Err
-			}
-		}
-	}
-	`, cid))
-
-	var graphqlResponse DealsResponseJson
-	if err := bc.bgql.Run(context.Background(), graphqlRequest, &graphqlResponse); err != nil {
-		panic(err)
+func (bc *BoostConnection) GetDealsForContent(cid string) (Deals, error) {
+	var deals Deals
+	err := bc.eachDeal([]string{fmt.Sprintf("query: %q", cid)}, dealFieldsContent, func(deal Deal) bool {
+		deals = append(deals, deal)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get deals for %s: %w", cid, err)
 	}
 
-	return graphqlResponse.Data.Deals
+	return deals, nil
 }
 
+// Base delay between checks in WaitForDeal. Each retry waits a multiple of this
+var WaitForDealRetryInterval = 10 * time.Second
+
 // Repeatedly attempts to wait, then query for a CID, returning an error if not found after 3 retries
 // Use this after requesting a deal, to allow time for it to be made with Boost
-func (bc *BoostConnection) WaitForDeal(pieceCid string) ([]Deal, error) {
+// Returns early with an error if ctx is cancelled
+func (bc *BoostConnection) WaitForDeal(ctx context.Context, pieceCid string) ([]Deal, error) {
 	retryCount := 1
 	var readyToImport []Deal
 
@@ -371,15 +407,22 @@ whileLoop:
 			return readyToImport, errors.New("deal not made after 3 retries")
 		}
 
-		time.Sleep(time.Second * 10 * time.Duration(retryCount))
+		select {
+		case <-ctx.Done():
+			return readyToImport, ctx.Err()
+		case <-time.After(WaitForDealRetryInterval * time.Duration(retryCount)):
+		}
 		// Check to see if the deals has been made
-		deals := bc.GetDealsForContent(pieceCid)
+		deals, err := bc.GetDealsForContent(pieceCid)
+		if err != nil {
+			return readyToImport, err
+		}
 		readyToImport = deals.ReadyForImport()
 
 		if len(readyToImport) > 0 {
 			break whileLoop
 		} else {
-			log.Debugf("deal for %d not seen in boost yet. retrying", pieceCid)
+			log.Debugf("deal for %s not seen in boost yet. retrying", pieceCid)
 			retryCount++
 		}
 	}
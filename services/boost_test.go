@@ -0,0 +1,88 @@
+package services_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	svc "github.com/application-research/delta-importer/services"
+	"github.com/application-research/delta-importer/services/fakeboost"
+)
+
+// Deals are read over more than one page, and decoded from the form Boost sends them in
+func TestGetDealsAwaitingImportPages(t *testing.T) {
+	fb, err := fakeboost.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Close()
+
+	count := svc.BOOST_DEALS_PAGE_SIZE*2 + 1
+	for i := 0; i < count; i++ {
+		fb.AddDeal(svc.Deal{
+			PieceCid:      fmt.Sprintf("baga%d", i),
+			IsOffline:     true,
+			ClientAddress: "f1aaa",
+			PieceSize:     fakeboost.PieceSize(32 << 30),
+			Checkpoint:    "Accepted",
+		})
+	}
+
+	bc, err := svc.NewBoostConnection(fb.Address(), fb.Port(), fb.Port(), "test", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	deals, err := bc.GetDealsAwaitingImport([]string{"f1aaa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deals) != count {
+		t.Fatalf("expected %d deals, got %d", count, len(deals))
+	}
+
+	seen := make(map[string]bool)
+	for _, d := range deals {
+		if seen[d.ID] {
+			t.Fatalf("deal %s returned more than once", d.ID)
+		}
+		seen[d.ID] = true
+		if d.PieceSize.Uint64() != 32<<30 {
+			t.Fatalf("expected piece size %d, got %d", 32<<30, d.PieceSize.Uint64())
+		}
+	}
+}
+
+// A failed query is returned to the caller, so a Boost outage doesn't crash the daemon
+func TestDealQueriesReturnErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boost is down", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := svc.NewBoostConnection(host, port, port, "test", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	if _, err := bc.GetDealsAwaitingImport([]string{"f1aaa"}); err == nil {
+		t.Error("expected GetDealsAwaitingImport to fail")
+	}
+	if err := bc.EachDealCompleted("f1aaa", func(svc.Deal) {}); err == nil {
+		t.Error("expected EachDealCompleted to fail")
+	}
+	if _, err := bc.GetDealsInPipeline(); err == nil {
+		t.Error("expected GetDealsInPipeline to fail")
+	}
+	if _, err := bc.GetDealsForContent("baga"); err == nil {
+		t.Error("expected GetDealsForContent to fail")
+	}
+}
@@ -3,6 +3,7 @@ package services
 import (
 	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/application-research/delta-importer/util"
 
@@ -14,21 +15,25 @@ type DealsResponseJson struct {
 }
 
 type DealsResponseData struct {
-	Deals Deals `json:"deals"`
+	Deals      Deals `json:"deals"`
+	TotalCount int   `json:"totalCount"`
+	More       bool  `json:"more"`
 }
 
 type Deals []Deal
 
 type Deal struct {
-	ID              string     `json:"ID"`
-	Message         string     `json:"Message"`
-	PieceCid        string     `json:"PieceCid"`
-	IsOffline       bool       `json:"IsOffline"`
-	ClientAddress   string     `json:"ClientAddress"`
-	Checkpoint      string     `json:"Checkpoint"`
-	StartEpoch      BoostEpoch `json:"StartEpoch"`
-	InboundFilePath string     `json:"InboundFilePath"`
-	Err             string     `json:"Err"`
+	ID              string      `json:"ID"`
+	Message         string      `json:"Message"`
+	PieceCid        string      `json:"PieceCid"`
+	IsOffline       bool        `json:"IsOffline"`
+	ClientAddress   string      `json:"ClientAddress"`
+	PieceSize       BoostUint64 `json:"PieceSize"`
+	Checkpoint      string      `json:"Checkpoint"`
+	StartEpoch      BoostEpoch  `json:"StartEpoch"`
+	InboundFilePath string      `json:"InboundFilePath"`
+	Err             string      `json:"Err"`
+	CreatedAt       time.Time   `json:"CreatedAt"`
 }
 
 type BoostEpoch struct {
@@ -46,6 +51,27 @@ func (epoch *BoostEpoch) IntoUnix() int64 {
 	return util.HeightToUnix(i)
 }
 
+// Boost sends Uint64 fields as a BigInt object, with the value as a string
+type BoostUint64 struct {
+	TypeName string `json:"__typename"`
+	Value    string `json:"n"`
+}
+
+// Returns 0 if the field wasn't requested
+func (u *BoostUint64) Uint64() uint64 {
+	if u.Value == "" {
+		return 0
+	}
+
+	i, err := strconv.ParseUint(u.Value, 10, 64)
+	if err != nil {
+		log.Error("could not parse uint64: " + err.Error())
+		return 0
+	}
+
+	return i
+}
+
 // checks if there are failed deals in a given array of deals
 func (ds Deals) HasMismatchedCommPErrors() bool {
 	failed := false
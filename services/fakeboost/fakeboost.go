@@ -0,0 +1,377 @@
+// Package fakeboost provides an in-process stand-in for Boost, for testing the importer without a real Boost node
+// It serves the GraphQL `deals` query and the `BoostOfflineDealWithData` RPC from an in-memory deal table
+package fakeboost
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	svc "github.com/application-research/delta-importer/services"
+	bapi "github.com/filecoin-project/boost/api"
+	jsonrpc "github.com/filecoin-project/go-jsonrpc"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Boost returns at most this many deals if no limit is given
+const DEFAULT_LIMIT = 10
+
+type FakeBoost struct {
+	mu       sync.Mutex
+	deals    []*svc.Deal
+	imports  map[string]Import
+	listener net.Listener
+	server   *http.Server
+
+	// OnImport, if set, is called when a deal is imported. Returning a non-empty string rejects the import with that reason
+	OnImport func(deal svc.Deal, filePath string) string
+}
+
+// Import records a call to BoostOfflineDealWithData
+type Import struct {
+	DealUuid          string
+	FilePath          string
+	DeleteAfterImport bool
+}
+
+// Start a fake Boost listening on a random localhost port
+// Both the RPC and GraphQL APIs are served on the same port
+func New() (*FakeBoost, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("could not listen: %w", err)
+	}
+
+	fb := &FakeBoost{
+		imports:  make(map[string]Import),
+		listener: listener,
+	}
+
+	rpcServer := jsonrpc.NewServer()
+	rpcServer.Register("Filecoin", &rpcHandler{fb: fb})
+
+	mux := http.NewServeMux()
+	mux.Handle("/rpc/v0", rpcServer)
+	mux.HandleFunc("/graphql/query", fb.handleGraphql)
+
+	fb.server = &http.Server{Handler: mux}
+	go func() {
+		if err := fb.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("fake boost server error: %s", err)
+		}
+	}()
+
+	return fb, nil
+}
+
+// Address to pass as the boost url
+func (fb *FakeBoost) Address() string {
+	return "127.0.0.1"
+}
+
+// Port to pass as both the boost rpc and graphql port
+func (fb *FakeBoost) Port() string {
+	return strconv.Itoa(fb.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (fb *FakeBoost) Close() error {
+	return fb.server.Close()
+}
+
+// AddDeal adds a deal to the deal table. Deals are returned newest-first, as Boost does
+func (fb *FakeBoost) AddDeal(deal svc.Deal) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if deal.ID == "" {
+		deal.ID = uuid.New().String()
+	}
+	if deal.CreatedAt.IsZero() {
+		deal.CreatedAt = time.Now()
+	}
+	fb.deals = append([]*svc.Deal{&deal}, fb.deals...)
+}
+
+// UpdateDeal applies update to the deal with the given ID, returning false if it doesn't exist
+func (fb *FakeBoost) UpdateDeal(id string, update func(deal *svc.Deal)) bool {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	for _, d := range fb.deals {
+		if d.ID == id {
+			update(d)
+			return true
+		}
+	}
+	return false
+}
+
+// Deals returns a copy of the deal table
+func (fb *FakeBoost) Deals() []svc.Deal {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	deals := make([]svc.Deal, 0, len(fb.deals))
+	for _, d := range fb.deals {
+		deals = append(deals, *d)
+	}
+	return deals
+}
+
+// Imports returns every import made so far, keyed by deal uuid
+func (fb *FakeBoost) Imports() map[string]Import {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	imports := make(map[string]Import, len(fb.imports))
+	for k, v := range fb.imports {
+		imports[k] = v
+	}
+	return imports
+}
+
+type rpcHandler struct {
+	fb *FakeBoost
+}
+
+func (h *rpcHandler) BoostOfflineDealWithData(ctx context.Context, dealUuid uuid.UUID, filePath string, delAfterImport bool) (*bapi.ProviderDealRejectionInfo, error) {
+	fb := h.fb
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	var deal *svc.Deal
+	for _, d := range fb.deals {
+		if d.ID == dealUuid.String() {
+			deal = d
+			break
+		}
+	}
+
+	if deal == nil {
+		return nil, fmt.Errorf("failed to get deal %s: not found", dealUuid)
+	}
+	if !deal.IsOffline {
+		return &bapi.ProviderDealRejectionInfo{Reason: "deal is not an offline deal"}, nil
+	}
+	if deal.Checkpoint != "Accepted" || deal.InboundFilePath != "" {
+		return &bapi.ProviderDealRejectionInfo{Reason: "deal has already been imported"}, nil
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+
+	if fb.OnImport != nil {
+		if reason := fb.OnImport(*deal, filePath); reason != "" {
+			return &bapi.ProviderDealRejectionInfo{Reason: reason}, nil
+		}
+	}
+
+	deal.InboundFilePath = filePath
+	deal.Message = "Verifying Commp"
+	fb.imports[deal.ID] = Import{DealUuid: deal.ID, FilePath: filePath, DeleteAfterImport: delAfterImport}
+
+	return nil, nil
+}
+
+type graphqlRequest struct {
+	Query string `json:"query"`
+}
+
+type graphqlResponse struct {
+	Data   interface{}    `json:"data,omitempty"`
+	Errors []graphqlError `json:"errors,omitempty"`
+}
+
+type graphqlError struct {
+	Message string `json:"message"`
+}
+
+var (
+	reDealsArgs = regexp.MustCompile(`deals\s*\(([^)]*)\)`)
+	reFilter    = regexp.MustCompile(`filter:\s*\{([^}]*)\}`)
+	reFilterArg = regexp.MustCompile(`(\w+):\s*(\w+)`)
+	reQuery     = regexp.MustCompile(`query:\s*"([^"]*)"`)
+	reLimit     = regexp.MustCompile(`limit:\s*(\d+)`)
+	reOffset    = regexp.MustCompile(`offset:\s*(\d+)`)
+	reCursor    = regexp.MustCompile(`cursor:\s*"([^"]*)"`)
+	reSelection = regexp.MustCompile(`\bdeals\s*\{([^{}]*)\}`)
+	reListField = regexp.MustCompile(`\b(totalCount|more)\b`)
+)
+
+// Serves the subset of the Boost `deals` query used by the importer
+// Only the selected fields are returned, in the same form Boost sends them
+func (fb *FakeBoost) handleGraphql(w http.ResponseWriter, r *http.Request) {
+	var req graphqlRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeGraphql(w, graphqlResponse{Errors: []graphqlError{{Message: err.Error()}}})
+		return
+	}
+
+	match := reDealsArgs.FindStringSubmatch(req.Query)
+	if match == nil {
+		writeGraphql(w, graphqlResponse{Errors: []graphqlError{{Message: "only the deals query is supported"}}})
+		return
+	}
+	args := match[1]
+
+	filter := make(map[string]string)
+	if f := reFilter.FindStringSubmatch(args); f != nil {
+		for _, kv := range reFilterArg.FindAllStringSubmatch(f[1], -1) {
+			filter[kv[1]] = kv[2]
+		}
+		args = strings.Replace(args, f[0], "", 1)
+	}
+
+	query := ""
+	if q := reQuery.FindStringSubmatch(args); q != nil {
+		query = q[1]
+	}
+
+	limit := DEFAULT_LIMIT
+	if l := reLimit.FindStringSubmatch(args); l != nil {
+		limit, _ = strconv.Atoi(l[1])
+	}
+
+	offset := 0
+	if o := reOffset.FindStringSubmatch(args); o != nil {
+		offset, _ = strconv.Atoi(o[1])
+	}
+
+	// Like Boost, a cursor starts the results at the deal with that ID, so deals added since aren't included
+	cursor := ""
+	if c := reCursor.FindStringSubmatch(args); c != nil {
+		cursor = c[1]
+	}
+
+	fb.mu.Lock()
+	var matched []svc.Deal
+	for _, d := range fb.deals {
+		if cursor != "" {
+			if d.ID != cursor {
+				continue
+			}
+			cursor = ""
+		}
+		if matchesFilter(d, filter) && matchesQuery(d, query) {
+			matched = append(matched, *d)
+		}
+	}
+	fb.mu.Unlock()
+
+	var page []svc.Deal
+	more := false
+	if offset < len(matched) {
+		end := offset + limit
+		if end > len(matched) {
+			end = len(matched)
+		}
+		page = matched[offset:end]
+		more = end < len(matched)
+	}
+
+	sel := reSelection.FindStringSubmatch(req.Query)
+	if sel == nil {
+		writeGraphql(w, graphqlResponse{Errors: []graphqlError{{Message: "no deal fields selected"}}})
+		return
+	}
+	fields := strings.Fields(sel[1])
+
+	deals := make([]map[string]interface{}, 0, len(page))
+	for _, d := range page {
+		deal := make(map[string]interface{})
+		for _, field := range fields {
+			value, ok := dealField(d, field)
+			if !ok {
+				writeGraphql(w, graphqlResponse{Errors: []graphqlError{{Message: fmt.Sprintf("Cannot query field %q on type \"Deal\".", field)}}})
+				return
+			}
+			deal[field] = value
+		}
+		deals = append(deals, deal)
+	}
+
+	result := map[string]interface{}{"deals": deals}
+	for _, field := range reListField.FindAllString(strings.Replace(req.Query, sel[0], "", 1), -1) {
+		switch field {
+		case "totalCount":
+			result["totalCount"] = len(matched)
+		case "more":
+			result["more"] = more
+		}
+	}
+
+	writeGraphql(w, graphqlResponse{Data: map[string]interface{}{"deals": result}})
+}
+
+// A deal field as Boost sends it. Uint64 and BigInt fields are objects holding the value as a string
+func dealField(d svc.Deal, field string) (interface{}, bool) {
+	switch field {
+	case "ID":
+		return d.ID, true
+	case "Message":
+		return d.Message, true
+	case "PieceCid":
+		return d.PieceCid, true
+	case "IsOffline":
+		return d.IsOffline, true
+	case "ClientAddress":
+		return d.ClientAddress, true
+	case "PieceSize":
+		return bigInt(d.PieceSize.Value), true
+	case "Checkpoint":
+		return d.Checkpoint, true
+	case "StartEpoch":
+		return bigInt(d.StartEpoch.Value), true
+	case "InboundFilePath":
+		return d.InboundFilePath, true
+	case "Err":
+		return d.Err, true
+	case "CreatedAt":
+		return d.CreatedAt, true
+	}
+	return nil, false
+}
+
+func bigInt(n string) map[string]string {
+	return map[string]string{"__typename": "BigInt", "n": n}
+}
+
+func matchesFilter(d *svc.Deal, filter map[string]string) bool {
+	if cp, ok := filter["Checkpoint"]; ok && d.Checkpoint != cp {
+		return false
+	}
+	if off, ok := filter["IsOffline"]; ok && strconv.FormatBool(d.IsOffline) != off {
+		return false
+	}
+	return true
+}
+
+// Like Boost, the query is a free-text search across several deal fields
+func matchesQuery(d *svc.Deal, query string) bool {
+	if query == "" {
+		return true
+	}
+	for _, field := range []string{d.ID, d.PieceCid, d.ClientAddress} {
+		if strings.Contains(field, query) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeGraphql(w http.ResponseWriter, resp graphqlResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Errorf("fake boost could not write graphql response: %s", err)
+	}
+}
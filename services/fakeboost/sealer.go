@@ -0,0 +1,110 @@
+package fakeboost
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	svc "github.com/application-research/delta-importer/services"
+	"github.com/application-research/delta-importer/util"
+)
+
+const START_EPOCH_PASSED = "deal start epoch has passed"
+
+// Sealer models a storage provider's sealing pipeline for deals imported into a FakeBoost
+// Imported deals wait for one of a fixed number of sealing workers, then take SealTime to reach Proving
+// Any deal that has not reached Proving by its start epoch fails
+type Sealer struct {
+	fb       *FakeBoost
+	workers  int
+	sealTime time.Duration
+	now      func() time.Time
+	waiting  []string
+	sealing  map[string]time.Time
+}
+
+// NewSealer creates a sealing pipeline model. now is the clock to use, which may be accelerated
+func (fb *FakeBoost) NewSealer(workers int, sealTime time.Duration, now func() time.Time) *Sealer {
+	return &Sealer{
+		fb:       fb,
+		workers:  workers,
+		sealTime: sealTime,
+		now:      now,
+		sealing:  make(map[string]time.Time),
+	}
+}
+
+// Step advances every deal in the pipeline to the current time
+func (s *Sealer) Step() {
+	s.fb.mu.Lock()
+	defer s.fb.mu.Unlock()
+
+	now := s.now()
+	byID := make(map[string]*svc.Deal, len(s.fb.deals))
+
+	// Iterate oldest-first, so deals are queued for sealing in the order they were imported
+	for i := len(s.fb.deals) - 1; i >= 0; i-- {
+		d := s.fb.deals[i]
+		byID[d.ID] = d
+
+		if d.Err != "" || d.Message == "Sealer: Proving" {
+			continue
+		}
+
+		if done, ok := s.sealing[d.ID]; ok && !done.After(now) {
+			d.Message = "Sealer: Proving"
+			delete(s.sealing, d.ID)
+			continue
+		}
+
+		if startEpochUnix(d) < now.Unix() {
+			d.Checkpoint = "Complete"
+			d.Err = START_EPOCH_PASSED
+			d.Message = "Error: " + START_EPOCH_PASSED
+			delete(s.sealing, d.ID)
+			continue
+		}
+
+		if d.Message == "Verifying Commp" {
+			d.Checkpoint = "IndexedAndAnnounced"
+			d.Message = "Sealer: WaitDeals"
+			s.waiting = append(s.waiting, d.ID)
+		}
+	}
+
+	for len(s.sealing) < s.workers && len(s.waiting) > 0 {
+		id := s.waiting[0]
+		s.waiting = s.waiting[1:]
+
+		d, ok := byID[id]
+		if !ok || d.Err != "" {
+			continue
+		}
+		d.Message = "Sealer: PreCommit1"
+		s.sealing[id] = now.Add(s.sealTime)
+	}
+}
+
+// Deals without a start epoch never expire
+func startEpochUnix(d *svc.Deal) int64 {
+	if d.StartEpoch.Value == "" {
+		return math.MaxInt64
+	}
+	return d.StartEpoch.IntoUnix()
+}
+
+// Returns a PieceSize for a deal with the given padded piece size
+func PieceSize(size uint64) svc.BoostUint64 {
+	return svc.BoostUint64{
+		TypeName: "BigInt",
+		Value:    strconv.FormatUint(size, 10),
+	}
+}
+
+// Returns a StartEpoch for a deal starting at the given time
+func StartEpochAt(t time.Time) svc.BoostEpoch {
+	return svc.BoostEpoch{
+		TypeName: "BigInt",
+		Value:    strconv.FormatInt(util.UnixToHeight(t.Unix()), 10),
+	}
+}
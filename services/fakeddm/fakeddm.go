@@ -0,0 +1,115 @@
+// Package fakeddm provides an in-process stand-in for the DDM self-service API
+package fakeddm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	svc "github.com/application-research/delta-importer/services"
+	log "github.com/sirupsen/logrus"
+)
+
+// Request is a single self-service deal request. Exactly one of Dataset or Cid is set
+type Request struct {
+	Dataset         string
+	Cid             string
+	StartEpochDelay uint
+	EndEpochAdvance uint
+}
+
+// DealMaker makes a deal for a request, returning the piece CID of the deal
+// Returning an empty string (with no error) indicates no deal could be made
+type DealMaker func(req Request) (string, error)
+
+type FakeDDM struct {
+	listener  net.Listener
+	server    *http.Server
+	makeDeal  DealMaker
+	authToken string
+}
+
+// Start a fake DDM listening on a random localhost port
+// Requests must carry authToken in the X-DELTA-AUTH header
+func New(authToken string, makeDeal DealMaker) (*FakeDDM, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("could not listen: %w", err)
+	}
+
+	fd := &FakeDDM{
+		listener:  listener,
+		makeDeal:  makeDeal,
+		authToken: authToken,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/self-service/by-dataset/", fd.handleRequest)
+	mux.HandleFunc("/api/v1/self-service/by-cid/", fd.handleRequest)
+
+	fd.server = &http.Server{Handler: mux}
+	go func() {
+		if err := fd.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("fake ddm server error: %s", err)
+		}
+	}()
+
+	return fd, nil
+}
+
+// URL to pass as the ddm-api
+func (fd *FakeDDM) URL() string {
+	return "http://" + fd.listener.Addr().String() + "/api/v1/self-service"
+}
+
+func (fd *FakeDDM) Close() error {
+	return fd.server.Close()
+}
+
+func (fd *FakeDDM) handleRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-DELTA-AUTH") != fd.authToken {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req Request
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/self-service/")
+	switch {
+	case strings.HasPrefix(path, "by-dataset/"):
+		req.Dataset = strings.TrimPrefix(path, "by-dataset/")
+	case strings.HasPrefix(path, "by-cid/"):
+		req.Cid = strings.TrimPrefix(path, "by-cid/")
+	}
+
+	if delay := r.URL.Query().Get("start_epoch_delay"); delay != "" {
+		d, err := strconv.ParseUint(delay, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid start_epoch_delay", http.StatusBadRequest)
+			return
+		}
+		req.StartEpochDelay = uint(d)
+	}
+	if advance := r.URL.Query().Get("end_epoch_advance"); advance != "" {
+		a, err := strconv.ParseUint(advance, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid end_epoch_advance", http.StatusBadRequest)
+			return
+		}
+		req.EndEpochAdvance = uint(a)
+	}
+
+	pieceCid, err := fd.makeDeal(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(svc.SelfServiceResponse{Cid: pieceCid}); err != nil {
+		log.Errorf("fake ddm could not write response: %s", err)
+	}
+}
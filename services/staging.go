@@ -0,0 +1,632 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/application-research/delta-importer/util"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+type StagingPlacement string
+
+const (
+	// Stage each carfile in the staging dir with the most free space
+	StagingMostFree StagingPlacement = "most-free"
+	// Take turns between the staging dirs, skipping any without room
+	StagingRoundRobin StagingPlacement = "round-robin"
+)
+
+type StagingStrategy string
+
+const (
+	// Copy the carfile's data into the staging dir
+	StagingCopy StagingStrategy = "copy"
+	// Hardlink the carfile into a staging dir on the same filesystem
+	StagingHardlink StagingStrategy = "hardlink"
+	// Clone the carfile into a staging dir on the same filesystem, sharing its data blocks (XFS, btrfs)
+	StagingReflink StagingStrategy = "reflink"
+	// Symlink to the carfile from the staging dir
+	StagingSymlink StagingStrategy = "symlink"
+)
+
+// ErrNoStagingSpace is returned when none of the staging dirs has room for a carfile
+var ErrNoStagingSpace = errors.New("no staging dir has enough free space")
+
+// Suffix of a carfile while it is being copied into a staging dir. It is renamed once the copy is complete
+const STAGING_TEMP_SUFFIX = ".staging"
+
+// Suffix of the file kept next to a prefetched carfile, holding its size, so it is still known to be prefetched after a restart
+const PREFETCH_MARKER_SUFFIX = ".prefetched"
+
+// Staging places carfiles in one of several staging dirs, checking the dir has room for them first
+// Space is reserved for copies that are in progress, so parallel imports don't overfill a dir
+type Staging struct {
+	dirs       []string
+	reserve    uint64 // Bytes to always leave free on each dir
+	placement  StagingPlacement
+	strategy   StagingStrategy
+	limiter    *rate.Limiter // Shared by all copies, so the total rate stays under the limit. nil = no limit
+	verify     bool          // Checksum each copy against its source
+	mu         sync.Mutex
+	next       int
+	inFlight   map[string]uint64        // Bytes being copied into each dir
+	staged     map[string]int           // Carfiles staged in each dir since the daemon started
+	failures   map[string]int           // Failed copies into each dir since the daemon started
+	copying    map[string]chan struct{} // Names being staged, closed when done
+	prefetched map[string]prefetchedFile
+	copies     map[string]*stagingCopy // Copies in progress, by name
+}
+
+// A copy into a staging dir that is in progress
+type stagingCopy struct {
+	source  string
+	dir     string
+	size    int64        // -1 if not known (a compressed carfile without its size in the header)
+	resumed atomic.Int64 // -1 until the copy has started
+	copied  atomic.Int64
+	started time.Time
+}
+
+// Progress of a copy into a staging dir
+type StagingCopyProgress struct {
+	Name    string
+	Source  string
+	Dir     string
+	Size    int64 // -1 if not known
+	Copied  int64
+	Resumed int64 // Offset the copy was resumed from
+	Started time.Time
+}
+
+// A carfile staged ahead of its import, that hasn't been imported yet
+type prefetchedFile struct {
+	path string
+	size uint64
+}
+
+// Usage of a staging dir
+type StagingDirUsage struct {
+	Dir       string
+	Total     uint64
+	Free      uint64
+	Available uint64 // Free space less the reserve and copies in progress
+	InFlight  uint64
+	Staged    int
+	Failures  int
+	Err       string
+}
+
+// rateLimit is the most bytes per second to read from carfile sources across all copies (0 = no limit)
+func NewStaging(dirs []string, reserve uint64, placement StagingPlacement, strategy StagingStrategy, rateLimit uint64, verify bool) *Staging {
+	var cleaned []string
+	for _, dir := range dirs {
+		cleaned = append(cleaned, filepath.Clean(dir))
+	}
+
+	var limiter *rate.Limiter
+	if rateLimit != 0 {
+		limiter = rate.NewLimiter(rate.Limit(rateLimit), util.COPY_CHUNK_SIZE)
+	}
+
+	return &Staging{
+		dirs:       cleaned,
+		reserve:    reserve,
+		placement:  placement,
+		strategy:   strategy,
+		limiter:    limiter,
+		verify:     verify,
+		inFlight:   make(map[string]uint64),
+		staged:     make(map[string]int),
+		failures:   make(map[string]int),
+		copying:    make(map[string]chan struct{}),
+		prefetched: make(map[string]prefetchedFile),
+		copies:     make(map[string]*stagingCopy),
+	}
+}
+
+func (s *Staging) Dirs() []string {
+	return s.dirs
+}
+
+func (s *Staging) Placement() StagingPlacement {
+	return s.placement
+}
+
+func (s *Staging) Strategy() StagingStrategy {
+	return s.strategy
+}
+
+func (s *Staging) Reserve() uint64 {
+	return s.reserve
+}
+
+// Returns true if the file is directly in one of the staging dirs
+func (s *Staging) Contains(path string) bool {
+	dir := filepath.Dir(path)
+	for _, d := range s.dirs {
+		if dir == d {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if at least one staging dir has space available above the reserve
+func (s *Staging) HasRoom() bool {
+	for _, u := range s.Usage() {
+		if u.Available > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Pick a staging dir with room for size bytes, and reserve the space until release is called
+// release should be called once the copy has finished (or failed), with whether it succeeded
+func (s *Staging) Place(size uint64) (dir string, release func(ok bool), err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	best := -1
+	var bestAvailable uint64
+	for i := range s.dirs {
+		// Round robin starts from the dir after the last one used, and takes the first with room
+		idx := i
+		if s.placement == StagingRoundRobin {
+			idx = (s.next + i) % len(s.dirs)
+		}
+
+		available, err := s.available(s.dirs[idx])
+		if err != nil {
+			log.Errorf("could not check free space of staging dir %s: %s", s.dirs[idx], err)
+			continue
+		}
+		if available < size {
+			log.Debugf("staging dir %s has %s available, not enough for %s", s.dirs[idx], util.BytesToReadable(int64(available)), util.BytesToReadable(int64(size)))
+			continue
+		}
+
+		if s.placement == StagingRoundRobin {
+			best = idx
+			break
+		}
+		if best == -1 || available > bestAvailable {
+			best, bestAvailable = idx, available
+		}
+	}
+
+	if best == -1 {
+		return "", nil, fmt.Errorf("%w for %s (keeping %s free on each)", ErrNoStagingSpace, util.BytesToReadable(int64(size)), util.BytesToReadable(int64(s.reserve)))
+	}
+
+	dir = s.dirs[best]
+	s.next = best + 1
+	return dir, s.reserveSpace(dir, size), nil
+}
+
+// Reserve size bytes in a particular staging dir (ex. to resume a partial file there) until release is called
+// Returns ErrNoStagingSpace if the dir doesn't have room
+func (s *Staging) PlaceIn(dir string, size uint64) (release func(ok bool), err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	available, err := s.available(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not check free space of staging dir %s: %w", dir, err)
+	}
+	if available < size {
+		return nil, fmt.Errorf("%w for %s in %s (keeping %s free)", ErrNoStagingSpace, util.BytesToReadable(int64(size)), dir, util.BytesToReadable(int64(s.reserve)))
+	}
+
+	return s.reserveSpace(dir, size), nil
+}
+
+// Reserve size bytes in a staging dir until release is called. Must be called with mu held
+func (s *Staging) reserveSpace(dir string, size uint64) func(ok bool) {
+	s.inFlight[dir] += size
+
+	return func(ok bool) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.inFlight[dir] -= size
+		if ok {
+			s.staged[dir]++
+		} else {
+			s.failures[dir]++
+		}
+	}
+}
+
+// Stage a carfile as name in a staging dir with room for it, decompressing it if it is compressed, and return its path
+// If it has already been staged (ex. by the prefetcher) the staged file is used. If it is being staged, waits for that to finish
+func (s *Staging) Stage(ctx context.Context, src string, name string) (string, error) {
+	return s.stage(ctx, src, name, false)
+}
+
+// Stage a carfile ahead of its import. It counts as prefetched until Stage is called for it, or it is evicted
+func (s *Staging) Prefetch(ctx context.Context, src string, name string) error {
+	_, err := s.stage(ctx, src, name, true)
+	return err
+}
+
+// Delete a prefetched carfile that is no longer expected to be imported. Does nothing if it has since been taken for import
+func (s *Staging) Evict(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.prefetched[name]
+	if !ok {
+		return
+	}
+	delete(s.prefetched, name)
+	os.Remove(f.path + PREFETCH_MARKER_SUFFIX)
+	if err := util.DeleteFile(f.path); err != nil && !os.IsNotExist(err) {
+		log.Errorf("failed to delete prefetched car file %s: %s", f.path, err)
+	}
+}
+
+// Pick up the carfiles prefetched before a restart, from the markers left next to them, so they can still be evicted
+// Returns the number of prefetched carfiles found
+func (s *Staging) RestorePrefetched() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	restored := 0
+	for _, dir := range s.dirs {
+		markers, err := filepath.Glob(filepath.Join(dir, "*"+PREFETCH_MARKER_SUFFIX))
+		if err != nil {
+			continue
+		}
+		for _, marker := range markers {
+			path := strings.TrimSuffix(marker, PREFETCH_MARKER_SUFFIX)
+			data, err := os.ReadFile(marker)
+			if err != nil {
+				log.Errorf("could not read prefetch marker %s: %s", marker, err)
+				continue
+			}
+			size, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+			if err != nil || !util.FileExists(path) {
+				// The carfile has since been imported (or the marker is corrupt)
+				os.Remove(marker)
+				continue
+			}
+			s.prefetched[filepath.Base(path)] = prefetchedFile{path: path, size: size}
+			restored++
+		}
+	}
+	return restored
+}
+
+// Names and total size of carfiles that have been prefetched but not yet imported
+func (s *Staging) Prefetched() ([]string, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	var size uint64
+	for name, f := range s.prefetched {
+		names = append(names, name)
+		size += f.size
+	}
+	return names, size
+}
+
+func (s *Staging) stage(ctx context.Context, src string, name string, prefetch bool) (string, error) {
+	// Wait for any copy of the same name to finish, then either use what it staged or stage it ourselves
+	for {
+		s.mu.Lock()
+		if path, ok := s.find(name); ok {
+			if !prefetch {
+				log.Debugf("using already staged car file %s", path)
+				delete(s.prefetched, name)
+				os.Remove(path + PREFETCH_MARKER_SUFFIX)
+			}
+			s.mu.Unlock()
+			return path, nil
+		}
+
+		done, busy := s.copying[name]
+		if !busy {
+			s.copying[name] = make(chan struct{})
+			s.mu.Unlock()
+			break
+		}
+		s.mu.Unlock()
+
+		log.Debugf("waiting for %s to finish staging", name)
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	path, size, err := s.copy(ctx, src, name)
+
+	s.mu.Lock()
+	close(s.copying[name])
+	delete(s.copying, name)
+	if err == nil && prefetch {
+		s.prefetched[name] = prefetchedFile{path: path, size: size}
+		if err := os.WriteFile(path+PREFETCH_MARKER_SUFFIX, []byte(strconv.FormatUint(size, 10)), 0644); err != nil {
+			log.Errorf("could not mark %s as prefetched, it won't be evicted if it is no longer needed after a restart: %s", path, err)
+		}
+	}
+	s.mu.Unlock()
+
+	return path, err
+}
+
+// Copy (or decompress) src into a staging dir with room for it, under a temporary name until the copy is complete
+// Returns the staged path, and the bytes of staging space it takes up (none for a link)
+func (s *Staging) copy(ctx context.Context, src string, name string) (string, uint64, error) {
+	// Compressed carfiles always have to be decompressed, so can't be linked
+	if s.strategy != StagingCopy && s.strategy != "" && !util.IsCompressed(src) {
+		path, err := s.link(src, name)
+		if err == nil {
+			return path, 0, nil
+		}
+		log.Warnf("could not %s %s into staging, copying it instead: %s", s.strategy, src, err)
+	}
+
+	// Space needed - the decompressed size of a compressed carfile, if we know it
+	compressed := util.IsCompressed(src)
+	size := util.FileSize(src)
+	if compressed {
+		size = -1
+		if decompressed, ok := util.DecompressedSize(src); ok {
+			size = decompressed
+		}
+	}
+
+	dir, release, err := s.placeCopy(name, size)
+	if err != nil {
+		return "", 0, err
+	}
+
+	path := filepath.Join(dir, name)
+	temp := path + STAGING_TEMP_SUFFIX
+	c := &stagingCopy{source: src, dir: dir, size: size, started: time.Now()}
+	c.resumed.Store(-1)
+	s.mu.Lock()
+	s.copies[name] = c
+	s.mu.Unlock()
+
+	if compressed {
+		log.Debugf("decompressing car file to staging dir %s", path)
+	} else {
+		log.Debugf("copying car file to staging dir %s", path)
+	}
+	resumed, err := util.CopyResumable(ctx, src, temp, util.CopyOptions{
+		Decompress: compressed,
+		Limiter:    s.limiter,
+		Verify:     s.verify,
+		Progress: func(copied int64) {
+			c.resumed.CompareAndSwap(-1, copied)
+			c.copied.Store(copied)
+		},
+	})
+	if resumed > 0 {
+		log.Infof("resumed copy of %s to staging dir %s from byte %d", src, path, resumed)
+	}
+	if err == nil {
+		err = os.Rename(temp, path)
+	}
+	release(err == nil)
+
+	s.mu.Lock()
+	delete(s.copies, name)
+	s.mu.Unlock()
+
+	// The partial copy is kept to be resumed on the next attempt
+	if err != nil {
+		if compressed {
+			return "", 0, fmt.Errorf("decompression failed: %w", err)
+		}
+		return "", 0, fmt.Errorf("copy failed: %w", err)
+	}
+
+	return path, uint64(util.FileSize(path)), nil
+}
+
+// Pick the staging dir to copy name into. A partial copy left by an earlier attempt is resumed where it is, if its dir has room for the rest
+func (s *Staging) placeCopy(name string, size int64) (string, func(ok bool), error) {
+	if size < 0 {
+		// Reserve nothing for a compressed carfile of unknown size - the free space check when the import cycle starts is all we can do
+		size = 0
+	}
+
+	s.mu.Lock()
+	for _, dir := range s.dirs {
+		fi, err := os.Lstat(filepath.Join(dir, name+STAGING_TEMP_SUFFIX))
+		if err != nil {
+			continue
+		}
+
+		remaining := uint64(0)
+		if fi.Size() < size {
+			remaining = uint64(size - fi.Size())
+		}
+		if available, err := s.available(dir); err == nil && available >= remaining {
+			release := s.reserveSpace(dir, remaining)
+			s.mu.Unlock()
+			return dir, release, nil
+		}
+
+		log.Warnf("staging dir %s no longer has room to resume copying %s, starting again", dir, name)
+		os.Remove(filepath.Join(dir, name+STAGING_TEMP_SUFFIX))
+	}
+	s.mu.Unlock()
+
+	return s.Place(uint64(size))
+}
+
+// Copies into the staging dirs that are in progress
+func (s *Staging) Copies() []StagingCopyProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var copies []StagingCopyProgress
+	for name, c := range s.copies {
+		resumed := c.resumed.Load()
+		if resumed < 0 {
+			resumed = 0
+		}
+		copies = append(copies, StagingCopyProgress{
+			Name:    name,
+			Source:  c.source,
+			Dir:     c.dir,
+			Size:    c.size,
+			Copied:  c.copied.Load(),
+			Resumed: resumed,
+			Started: c.started,
+		})
+	}
+	sort.Slice(copies, func(i, j int) bool { return copies[i].Started.Before(copies[j].Started) })
+	return copies
+}
+
+// Stage src as name with the link strategy. Hardlinks and reflinks are made in a staging dir on the same filesystem as src
+func (s *Staging) link(src string, name string) (string, error) {
+	var dir string
+	if s.strategy == StagingSymlink {
+		// A symlink takes up no space, but still goes through placement so staging dirs take turns
+		d, release, err := s.Place(0)
+		if err != nil {
+			return "", err
+		}
+		release(true)
+		dir = d
+	} else {
+		d, err := s.sameFilesystem(src)
+		if err != nil {
+			return "", err
+		}
+		dir = d
+	}
+
+	path := filepath.Join(dir, name)
+	temp := path + STAGING_TEMP_SUFFIX
+	os.Remove(temp)
+
+	var err error
+	switch s.strategy {
+	case StagingHardlink:
+		log.Debugf("hardlinking car file to staging dir %s", path)
+		err = os.Link(src, temp)
+	case StagingReflink:
+		log.Debugf("reflinking car file to staging dir %s", path)
+		err = util.Reflink(src, temp)
+	case StagingSymlink:
+		log.Debugf("symlinking car file from staging dir %s", path)
+		var abs string
+		if abs, err = filepath.Abs(src); err == nil {
+			err = os.Symlink(abs, temp)
+		}
+	default:
+		err = fmt.Errorf("unknown staging strategy %q", s.strategy)
+	}
+	if err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return "", err
+	}
+
+	if s.strategy != StagingSymlink {
+		s.mu.Lock()
+		s.staged[dir]++
+		s.mu.Unlock()
+	}
+	return path, nil
+}
+
+// The first staging dir on the same filesystem as path
+func (s *Staging) sameFilesystem(path string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", err
+	}
+
+	for _, dir := range s.dirs {
+		var dst syscall.Stat_t
+		if err := syscall.Stat(dir, &dst); err == nil && dst.Dev == st.Dev {
+			return dir, nil
+		}
+	}
+	return "", errors.New("no staging dir is on the same filesystem")
+}
+
+// Find a carfile that has already been staged in any of the staging dirs
+func (s *Staging) find(name string) (string, bool) {
+	for _, dir := range s.dirs {
+		path := filepath.Join(dir, name)
+		if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// Bytes that can be staged in dir - its free space, less the reserve and copies in progress. Must be called with mu held
+func (s *Staging) available(dir string) (uint64, error) {
+	free, _, err := diskSpace(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	used := s.reserve + s.inFlight[dir]
+	if free < used {
+		return 0, nil
+	}
+	return free - used, nil
+}
+
+// Current usage of each staging dir
+func (s *Staging) Usage() []StagingDirUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var usage []StagingDirUsage
+	for _, dir := range s.dirs {
+		u := StagingDirUsage{
+			Dir:      dir,
+			InFlight: s.inFlight[dir],
+			Staged:   s.staged[dir],
+			Failures: s.failures[dir],
+		}
+
+		free, total, err := diskSpace(dir)
+		if err != nil {
+			u.Err = err.Error()
+		} else {
+			u.Free, u.Total = free, total
+			u.Available, _ = s.available(dir)
+		}
+		usage = append(usage, u)
+	}
+
+	return usage
+}
+
+// Free (available to unprivileged users) and total bytes on the filesystem dir is on
+func diskSpace(dir string) (uint64, uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
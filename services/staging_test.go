@@ -0,0 +1,59 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	svc "github.com/application-research/delta-importer/services"
+)
+
+// Carfiles prefetched before a restart are still known to be prefetched, so they can be evicted or taken for import
+func TestPrefetchedSurvivesRestart(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "source")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("car data "), 1000)
+	for _, name := range []string{"baga-evicted.car", "baga-imported.car"} {
+		if err := os.WriteFile(filepath.Join(src, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	before := svc.NewStaging([]string{dir}, 0, svc.StagingMostFree, svc.StagingCopy, 0, false)
+	for _, name := range []string{"baga-evicted.car", "baga-imported.car"} {
+		if err := before.Prefetch(context.Background(), filepath.Join(src, name), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	after := svc.NewStaging([]string{dir}, 0, svc.StagingMostFree, svc.StagingCopy, 0, false)
+	if restored := after.RestorePrefetched(); restored != 2 {
+		t.Fatalf("expected 2 prefetched car files to be restored, got %d", restored)
+	}
+	names, size := after.Prefetched()
+	if len(names) != 2 || size != uint64(2*len(content)) {
+		t.Fatalf("expected 2 prefetched car files of %d bytes, got %v of %d bytes", 2*len(content), names, size)
+	}
+
+	after.Evict("baga-evicted.car")
+	if _, err := os.Stat(filepath.Join(dir, "baga-evicted.car")); !os.IsNotExist(err) {
+		t.Errorf("expected the restored car file to be evicted, got %v", err)
+	}
+
+	if _, err := after.Stage(context.Background(), filepath.Join(src, "baga-imported.car"), "baga-imported.car"); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := after.Prefetched(); len(names) != 0 {
+		t.Errorf("expected no prefetched car files left, got %v", names)
+	}
+
+	// Nothing is left to be picked up after another restart
+	if restored := svc.NewStaging([]string{dir}, 0, svc.StagingMostFree, svc.StagingCopy, 0, false).RestorePrefetched(); restored != 0 {
+		t.Errorf("expected no prefetched car files to be restored, got %d", restored)
+	}
+}
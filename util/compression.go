@@ -0,0 +1,105 @@
+package util
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Extensions of compressed carfiles (ex. <pieceCid>.car.zst), which are decompressed into the staging dir to import
+var CompressedCarExtensions = []string{".zst", ".gz"}
+
+// Returns true if the file name is a carfile - .car, or .car followed by a compression extension
+func IsCarFile(name string) bool {
+	return strings.HasSuffix(TrimCompressionExt(name), ".car")
+}
+
+// Returns true if the file has a compression extension
+func IsCompressed(path string) bool {
+	return TrimCompressionExt(path) != path
+}
+
+// Returns the path without its compression extension, if it has one
+func TrimCompressionExt(path string) string {
+	ext := filepath.Ext(path)
+	for _, c := range CompressedCarExtensions {
+		if ext == c {
+			return strings.TrimSuffix(path, ext)
+		}
+	}
+	return path
+}
+
+// Opens a carfile for reading, decompressing it if it is compressed
+func OpenCarFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch filepath.Ext(path) {
+	case ".zst":
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &decompressReader{r: zr, closers: []func() error{func() error { zr.Close(); return nil }, f.Close}}, nil
+	case ".gz":
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &decompressReader{r: gr, closers: []func() error{gr.Close, f.Close}}, nil
+	}
+
+	return f, nil
+}
+
+// Returns the size of a compressed carfile once decompressed, if it is recorded in the file
+// Only zstd records this (in the frame header), and only when the compressor knew the size up front
+func DecompressedSize(path string) (int64, bool) {
+	if filepath.Ext(path) != ".zst" {
+		return 0, false
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	buf := make([]byte, zstd.HeaderMaxSize)
+	n, _ := io.ReadFull(f, buf)
+
+	var h zstd.Header
+	if err := h.Decode(buf[:n]); err != nil || !h.HasFCS {
+		return 0, false
+	}
+	return int64(h.FrameContentSize), true
+}
+
+// decompressReader closes the decompressor and then the underlying file
+type decompressReader struct {
+	r       io.Reader
+	closers []func() error
+}
+
+func (d *decompressReader) Read(p []byte) (int, error) {
+	return d.r.Read(p)
+}
+
+func (d *decompressReader) Close() error {
+	var err error
+	for _, c := range d.closers {
+		if cerr := c(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/time/rate"
+)
+
+// Most bytes read from the source in one go, so a rate limited copy is throttled smoothly
+const COPY_CHUNK_SIZE = 256 << 10
+
+// CopyOptions control how CopyResumable copies a file
+type CopyOptions struct {
+	Decompress bool               // Write the decompressed contents of a compressed carfile
+	Limiter    *rate.Limiter      // Limits the bytes read from src per second, and may be shared between copies. nil = no limit
+	Verify     bool               // Check the sha256 of dst matches what was read from src
+	Progress   func(copied int64) // Called with the size of dst - first with the size being resumed from, then as it is written
+}
+
+// CopyResumable copies src to dst, carrying on from the end of dst if it holds part of a copy from an earlier attempt
+// dst is kept if the copy fails or is cancelled, so it can be resumed. It is removed if it fails verification
+// Returns the offset the copy was resumed from
+func CopyResumable(ctx context.Context, src string, dst string, opts CopyOptions) (int64, error) {
+	var in io.ReadCloser
+	var err error
+	if opts.Decompress {
+		in, err = OpenCarFile(src)
+	} else {
+		in, err = os.Open(src)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	// Expected size of the copy, or -1 if it isn't known until the end of a compressed file
+	expected := int64(-1)
+	if opts.Decompress {
+		if size, ok := DecompressedSize(src); ok {
+			expected = size
+		}
+	} else if fi, err := os.Stat(src); err == nil {
+		expected = fi.Size()
+	}
+
+	offset := resumeOffset(dst, expected)
+
+	var r io.Reader = &contextReader{ctx: ctx, r: in}
+	if opts.Limiter != nil {
+		r = &limitedReader{ctx: ctx, r: r, limiter: opts.Limiter}
+	}
+
+	var srcHash hash.Hash
+	if opts.Verify {
+		srcHash = sha256.New()
+		r = io.TeeReader(r, srcHash)
+	}
+
+	if opts.Progress != nil {
+		opts.Progress(offset)
+	}
+
+	// Skip the part already copied. It has to be read to get past it in a compressed file, or to include it in the checksum
+	if offset > 0 {
+		if seeker, ok := in.(io.Seeker); ok && !opts.Verify {
+			_, err = seeker.Seek(offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, r, offset)
+		}
+		if err != nil {
+			return offset, fmt.Errorf("could not skip the %d bytes already copied: %w", offset, err)
+		}
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return offset, err
+	}
+	written, err := io.Copy(&progressWriter{w: out, copied: offset, progress: opts.Progress}, r)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return offset, err
+	}
+
+	size := offset + written
+	if expected >= 0 && size != expected {
+		os.Remove(dst)
+		return offset, fmt.Errorf("copied %d bytes, but expected %d", size, expected)
+	}
+
+	if opts.Verify {
+		dstHash, err := sha256File(ctx, dst)
+		if err != nil {
+			return offset, fmt.Errorf("could not checksum copy: %w", err)
+		}
+		if !bytes.Equal(dstHash, srcHash.Sum(nil)) {
+			os.Remove(dst)
+			return offset, fmt.Errorf("checksum of copy %x does not match source %x", dstHash, srcHash.Sum(nil))
+		}
+	}
+
+	return offset, nil
+}
+
+// Size of the partial copy at dst that can be resumed, removing it if it can't be
+// A hardlink may share its data with a source carfile, so is never written to
+func resumeOffset(dst string, expected int64) int64 {
+	fi, err := os.Lstat(dst)
+	if err != nil {
+		return 0
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.Mode().IsRegular() || (ok && st.Nlink > 1) || (expected >= 0 && fi.Size() > expected) {
+		os.Remove(dst)
+		return 0
+	}
+	return fi.Size()
+}
+
+func sha256File(ctx context.Context, path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, &contextReader{ctx: ctx, r: f}); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// limitedReader waits for the rate limiter before each read
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > COPY_CHUNK_SIZE {
+		p = p[:COPY_CHUNK_SIZE]
+	}
+	if err := lr.limiter.WaitN(lr.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return lr.r.Read(p)
+}
+
+// progressWriter reports the size written so far
+type progressWriter struct {
+	w        io.Writer
+	copied   int64
+	progress func(int64)
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.copied += int64(n)
+	if pw.progress != nil {
+		pw.progress(pw.copied)
+	}
+	return n, err
+}
@@ -0,0 +1,106 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyResumable(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100000)
+	corrupt := append([]byte(nil), content[:5000]...)
+	corrupt[10] = 'x'
+
+	cases := []struct {
+		name      string
+		partial   []byte // Contents of dst before the copy, nil if it doesn't exist
+		hardlink  bool   // dst is a hardlink to another file holding partial
+		verify    bool
+		cancelled bool
+		appendSrc bool // The source grows once the copy has started
+		offset    int64
+		fails     bool
+		expected  []byte // Contents of dst after the copy, nil if it should be removed
+	}{
+		{name: "fresh copy", expected: content},
+		{name: "resumes a partial copy", partial: content[:5000], offset: 5000, expected: content},
+		{name: "resumes and verifies a partial copy", partial: content[:5000], verify: true, offset: 5000, expected: content},
+		{name: "partial copy that doesn't match fails verification", partial: corrupt, verify: true, offset: 5000, fails: true},
+		{name: "copy larger than the source starts again", partial: append(content, 'x'), expected: content},
+		{name: "hardlink is never written to", partial: content[:5000], hardlink: true, expected: content},
+		{name: "cancelled copy is kept to resume", partial: content[:5000], cancelled: true, offset: 5000, fails: true, expected: content[:5000]},
+		{name: "source changing size fails", appendSrc: true, fails: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src.car")
+			dst := filepath.Join(dir, "dst.car")
+			if err := os.WriteFile(src, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			linked := filepath.Join(dir, "linked.car")
+			if c.partial != nil {
+				partialFile := dst
+				if c.hardlink {
+					partialFile = linked
+				}
+				if err := os.WriteFile(partialFile, c.partial, 0644); err != nil {
+					t.Fatal(err)
+				}
+				if c.hardlink {
+					if err := os.Link(linked, dst); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if c.cancelled {
+				cancel()
+			}
+
+			opts := CopyOptions{Verify: c.verify}
+			if c.appendSrc {
+				opts.Progress = func(copied int64) {
+					if copied == 0 {
+						f, err := os.OpenFile(src, os.O_WRONLY|os.O_APPEND, 0644)
+						if err != nil {
+							t.Fatal(err)
+						}
+						f.Write([]byte("more"))
+						f.Close()
+					}
+				}
+			}
+
+			offset, err := CopyResumable(ctx, src, dst, opts)
+			if (err != nil) != c.fails {
+				t.Fatalf("expected failure to be %t, got %v", c.fails, err)
+			}
+			if offset != c.offset {
+				t.Errorf("expected to resume from %d, got %d", c.offset, offset)
+			}
+
+			got, err := os.ReadFile(dst)
+			if c.expected == nil {
+				if !os.IsNotExist(err) {
+					t.Errorf("expected dst to be removed, got %v", err)
+				}
+			} else if !bytes.Equal(got, c.expected) {
+				t.Errorf("expected dst to hold %d bytes, got %d bytes (%v)", len(c.expected), len(got), err)
+			}
+
+			if c.hardlink {
+				if got, _ := os.ReadFile(linked); !bytes.Equal(got, c.partial) {
+					t.Errorf("expected the hardlinked file to be left as it was")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package util
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reflink creates dst as a copy-on-write clone of src, sharing its data blocks (ex. on XFS or btrfs)
+// Fails if the filesystem doesn't support reflinks, or src and dst are on different filesystems
+func Reflink(src string, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		out.Close()
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	return unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package util
+
+import "errors"
+
+// Reflink is only supported on linux
+func Reflink(src string, dst string) error {
+	return errors.New("reflinks are not supported on this platform")
+}
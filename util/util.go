@@ -1,11 +1,13 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"math"
 	"os"
 	"path/filepath"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -27,6 +29,11 @@ func FileExists(path string) bool {
 	return true
 }
 
+// Returns true if the path is an http(s) URL rather than a local file
+func IsURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
 func FileSize(path string) int64 {
 	s, err := os.Stat(path)
 	if err != nil {
@@ -80,30 +87,15 @@ func BytesToReadable(bytes int64) string {
 	return fmt.Sprintf("%.1f %s", size, suffix[exp])
 }
 
-// CopyFile copies a file from src to dst
-func CopyFile(src string, dst string) error {
-	in, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer in.Close()
-
-	out, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-
-	defer out.Close()
+// contextReader stops reading once its context has been cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
 
-	_, err = io.Copy(out, in)
-	if err != nil {
-		return err
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
 	}
-
-	err = out.Sync()
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return cr.r.Read(p)
 }